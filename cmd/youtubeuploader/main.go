@@ -16,22 +16,36 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	yt "github.com/porjo/youtubeuploader"
 	"github.com/porjo/youtubeuploader/internal/limiter"
+	"github.com/porjo/youtubeuploader/internal/metrics"
 	"github.com/porjo/youtubeuploader/internal/utils"
 	"google.golang.org/api/googleapi"
 )
 
 const inputTimeLayout = "15:04"
 
+// bandwidthProbe is how long the upload runs unlimited to measure bandwidth for -bandwidthShare
+const bandwidthProbe = 5 * time.Second
+
+// exitInterrupted is the exit code used when the upload is stopped by SIGINT or SIGTERM
+const exitInterrupted = 3
+
 type arrayFlags []string
 
 // String is an implementation of the flag.Value interface
@@ -45,41 +59,233 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
+// sizeFlag is a size in bytes, which can be given with a suffix e.g. 8MB
+type sizeFlag int
+
+// String is an implementation of the flag.Value interface
+func (s *sizeFlag) String() string {
+	return strconv.Itoa(int(*s))
+}
+
+// Set is an implementation of the flag.Value interface
+func (s *sizeFlag) Set(value string) error {
+	size, err := utils.ParseSize(value)
+	if err != nil {
+		return err
+	}
+	*s = sizeFlag(size)
+	return nil
+}
+
+// notifyFlag is 'true', 'false' or 'auto'. It's a boolean flag, so -notify on its own means true
+type notifyFlag string
+
+// String is an implementation of the flag.Value interface
+func (n *notifyFlag) String() string {
+	return string(*n)
+}
+
+// Set is an implementation of the flag.Value interface
+func (n *notifyFlag) Set(value string) error {
+	if strings.EqualFold(value, "auto") {
+		*n = "auto"
+		return nil
+	}
+	notify, err := strconv.ParseBool(value)
+	if err != nil {
+		return errors.New("must be 'true', 'false' or 'auto'")
+	}
+	*n = notifyFlag(strconv.FormatBool(notify))
+	return nil
+}
+
+// IsBoolFlag allows -notify to be given without a value
+func (n *notifyFlag) IsBoolFlag() bool {
+	return true
+}
+
 // this is set at compile time to match git tag
 var appVersion string = "unknown"
 
+var (
+	// cleanups are run before exiting, including on error
+	cleanups []func()
+
+	// logBuffer holds log output when -quietErrors is set
+	logBuffer    *utils.LogBuffer
+	errorLogFile string
+)
+
 func main() {
 
 	var err error
 
 	var playlistIDs arrayFlags
+	var alsoUpload arrayFlags
+	var metaJSON arrayFlags
 	var recordingDate yt.Date
+	var publishAt yt.Date
 
 	flag.Var(&playlistIDs, "playlistID", "playlist ID to add the video to. Can be used multiple times")
+	flag.Var(&metaJSON, "metaJSON", "JSON file containing title,description,tags etc (optional). Can be used multiple times, later files take precedence")
+	flag.Var(&alsoUpload, "alsoUpload", "token cache file of another channel to also upload the video to. Can be used multiple times")
 	flag.Var(&recordingDate, "recordingDate", "recording date e.g. 2024-11-23")
+	recordingDateFromFile := flag.Bool("recordingDateFromFile", false, "if no recording date is given, use the creation time from the video's metadata (requires ffprobe) or the file's modification time")
+	flag.Var(&publishAt, "publishAt", "publish date/time for a private video e.g. 2024-11-23T10:00:00+10:00, or relative to now e.g. +2h, +3d")
 
-	filename := flag.String("filename", "", "video filename. Can be a URL. Read from stdin with '-'")
+	short := flag.Bool("short", false, "upload the video as a YouTube Short: adds #Shorts to the description, and warns if the video is too long or isn't vertical")
+	readBufferSize := sizeFlag(0)
+	flag.Var(&readBufferSize, "readBufferSize", "read the video through a buffer of this size e.g. 4MB, which can improve throughput on fast links. It doesn't affect -ratelimit")
+	splitAt := flag.Duration("splitAt", 0, "split the video into parts of this length e.g. 11h, and upload each part titled with '(Part 1/3)' etc. Requires ffmpeg")
+	partThumbnails := flag.Bool("partThumbnails", false, "with -splitAt, give each part its own thumbnail, a frame from the middle of the part. Otherwise -thumbnail is shared by every part")
+	checkSourceOnly := flag.Bool("checkSourceOnly", false, "check that the -filename URL is reachable and looks like a video, print its size and content type, and exit without uploading")
+	manifestFile := flag.String("manifest", "", "JSON file listing videos to upload, each with its own filename, thumbnail and metadata")
+	filename := flag.String("filename", "", "video filename. Can be a URL, or a directory to upload every video in it. Read from stdin with '-'")
+	strictContentType := flag.Bool("strictContentType", false, "refuse to upload a video whose content isn't clearly a video, rather than warning. Piped videos can't be checked, so are refused")
+	stdinFormat := flag.String("stdinFormat", "", "format of a video read from stdin or a pipe, as a file extension e.g. mp4 or a content type e.g. video/mp4")
+	postUploadCommand := flag.String("postUploadCommand", "", "command run after a successful upload e.g. 'mv {filename} archive/'. {videoId}, {videoUrl} and {filename} are replaced")
+	moveAfterUpload := flag.String("moveAfterUpload", "", "directory to move the video file to after it's uploaded e.g. done/")
+	postFailCommand := flag.String("postFailCommand", "", "command run if the upload fails. {filename} and {error} are replaced")
+	watchDir := flag.String("watch", "", "directory to watch, uploading each new video that appears in it until interrupted. Requires -uploadedList")
+	extensionList := flag.String("extensions", "", "comma separated file extensions of the videos to upload from a directory or -watch e.g. mp4,mkv,mov. By default all common video extensions are used")
+	minFileAge := flag.Duration("minFileAge", 0, "when uploading a directory, skip videos modified more recently than this e.g. 30s, as they may still be being written")
+	tempDir := flag.String("tempDir", "", "directory for temporary files, such as preprocessed videos, split parts and extracted thumbnails. Defaults to the OS temporary directory")
+	keepTemp := flag.Bool("keepTemp", false, "keep temporary files instead of removing them, for debugging")
+	preprocess := flag.String("preprocess", "", "command run on the video before uploading e.g. 'ffmpeg -i {input} -an {output}'. {input} and {output} are replaced with the video and a temporary output file")
 	thumbnail := flag.String("thumbnail", "", "thumbnail filename. Can be a URL")
+	playlistThumbnail := flag.String("playlistThumbnail", "", "image to use as the thumbnail of playlists created for the video by playlistTitles. Can be a URL")
+	targetChannel := flag.String("targetChannel", "", "ID of the channel to upload to. Fails if the authorized channel doesn't match, unless -contentOwner is set")
+	contentOwner := flag.String("contentOwner", "", "content owner ID to upload on behalf of. Requires -targetChannel")
+	dumpToken := flag.Bool("dumpToken", false, "print the expiry, scopes and refresh token status of the cached OAuth token, without the token values, then exit")
+	listChannels := flag.Bool("listChannels", false, "list the channels that videos can be uploaded to, then exit")
+	videoID := flag.String("videoID", "", "ID of an existing video, used with -describe and -exportMeta")
+	exportMeta := flag.String("exportMeta", "", "write the metadata of the video given by -videoID to this file in -metaJSON format, instead of uploading a video")
+	describe := flag.String("describe", "", "print the metadata of the video given by -videoID as 'human' readable text or 'json', instead of uploading a video")
+	watermark := flag.String("watermark", "", "set this image as the channel branding watermark, instead of uploading a video")
 	caption := flag.String("caption", "", "caption filename. Can be a URL")
+	failOnPartialMeta := flag.Bool("failOnPartialMeta", true, "fail before uploading if any thumbnail or caption files are missing. Specify '-failOnPartialMeta=false' to upload without them")
 	title := flag.String("title", "", "video title")
+	titleCleanup := flag.String("titleCleanup", "", "comma separated rules used to tidy titles made from filenames: prefix (strip a leading date or number), spaces (replace underscores and dots), titlecase, or all")
+	filenamePattern := flag.String("filenamePattern", "", "regular expression with named groups (title, description, categoryId, recordingDate, tags) used to read metadata from the filename")
+	expandEnv := flag.Bool("expandEnv", false, "replace ${VAR} in the title, description and tags with the value of environment variable VAR")
+	expandEnvStrict := flag.Bool("expandEnvStrict", false, "with -expandEnv, fail if a variable isn't defined instead of leaving it blank")
+	normalizeTitle := flag.Bool("normalizeTitle", false, "normalize the title to Unicode NFC form and remove control and zero-width characters")
+	sanitizeTitle := flag.Bool("sanitizeTitle", false, "remove characters YouTube doesn't allow ('<' and '>') from the title")
+	sanitizeDescription := flag.Bool("sanitizeDescription", false, "remove characters YouTube doesn't allow ('<' and '>') from the description")
 	description := flag.String("description", "uploaded by youtubeuploader", "video description")
-	language := flag.String("language", "en", "video language")
+	language := flag.String("language", localeLanguage(), "video language. Defaults to the language of the locale (LC_ALL, LC_MESSAGES or LANG), or en")
 	categoryId := flag.String("categoryId", "", "video category Id")
+	inferCategory := flag.Bool("inferCategory", false, "when no category is given, use the category most used by the channel's recent uploads")
+	requireTags := flag.Bool("requireTags", false, "fail before uploading if the video has no tags")
+	requireDescription := flag.Bool("requireDescription", false, "fail before uploading if the video has no description. The default -description doesn't count")
+	requireCategory := flag.Bool("requireCategory", false, "fail before uploading if the video has no category")
 	tags := flag.String("tags", "", "comma separated list of video tags")
+	normalizeTags := flag.Bool("normalizeTags", false, "remove leading '#' characters and surrounding spaces from tags")
+	lowercaseTags := flag.Bool("lowercaseTags", false, "with -normalizeTags, convert tags to lower case")
 	privacy := flag.String("privacy", "private", "video privacy status")
+	license := flag.String("license", "", "video license: 'youtube' or 'creativeCommon'. YouTube's default is used if not set")
+	uploadThenPublic := flag.Bool("uploadThenPublic", false, "upload the video as private, then make it public once YouTube has processed it successfully")
 	quiet := flag.Bool("quiet", false, "suppress progress indicator")
+	summaryOnly := flag.Bool("summaryOnly", false, "suppress all output except a summary of the uploads at the end (video ID, URL, size, time and retries). Errors are still logged")
 	rateLimit := flag.Int("ratelimit", 0, "rate limit upload in Kbps. No limit by default")
-	metaJSON := flag.String("metaJSON", "", "JSON file containing title,description,tags etc (optional)")
+	bandwidthShare := flag.String("bandwidthShare", "", "limit the upload to a percentage of the available bandwidth e.g. '50%', measured at the start of the upload")
 	metaJSONout := flag.String("metaJSONout", "", "filename to write uploaded video metadata into (optional)")
+	preset := flag.String("preset", "", "name of a preset of metadata defaults to apply. Flags and metaJSON take precedence over the preset")
+	presetsFile := flag.String("presetsFile", "", "JSON file containing presets (default \"presets.json\" in the OS specific config dir)")
+	stateFile := flag.String("stateFile", "", "file recording the checksums of uploaded files. Files that were already uploaded are skipped")
+	minFreeSpace := sizeFlag(0)
+	flag.Var(&minFreeSpace, "minFreeSpace", "free space to leave in the temporary directory when -preprocess writes its output there e.g. 1GB. Space for a file the size of the video is always required")
+	strictChunksize := flag.Bool("strictChunksize", false, "fail if -chunksize isn't a multiple of 256KB, rather than rounding it down")
+	validateLanguage := flag.Bool("validateLanguage", false, "check that -language and caption languages are valid BCP-47 codes e.g. en-US")
+	feedFile := flag.String("feed", "", "Atom feed file that each uploaded video is added to, e.g. to subscribe to the uploads in a feed reader")
+	uploadedList := flag.String("uploadedList", "", "file to append the name of each uploaded video file to")
+	abortIfExists := flag.Bool("abortIfExists", false, "skip video files already named in the -uploadedList file")
+	metaOutFields := flag.String("metaOutFields", "full", "what to write to -metaJSONout: 'full' (the video resource returned by YouTube) or 'minimal' (the video ID and -metaJSON fields)")
+	metaOutIndent := flag.Int("metaOutIndent", 0, "number of spaces to indent -metaJSONout by. 0 writes it on one line")
+	metaOutConflict := flag.String("metaOutConflict", "overwrite", "what to do when the -metaJSONout file already exists: 'overwrite', 'skip', 'fail' or 'append-suffix'")
 	limitBetween := flag.String("limitBetween", "", "only rate limit between these times e.g. 10:00-14:00 (local time zone)")
+	uploadBetween := flag.String("uploadBetween", "", "only upload between these times e.g. 01:00-06:00 (local time zone). Outside them, the upload waits for the next window")
 	oAuthPort := flag.Int("oAuthPort", 8080, "TCP port to listen on when requesting an oAuth token")
+	scopes := flag.String("scopes", "", "comma separated OAuth scopes to ask for instead of the default ones e.g. 'youtube.upload,youtube.readonly'. Must include youtube.upload")
 	showAppVersion := flag.Bool("version", false, "show version")
-	chunksize := flag.Int("chunksize", googleapi.DefaultUploadChunkSize, "size (in bytes) of each upload chunk. A zero value will cause all data to be uploaded in a single request")
-	notifySubscribers := flag.Bool("notify", true, "notify channel subscribers of new video. Specify '-notify:=false' to disable.")
+	chunksize := sizeFlag(googleapi.DefaultUploadChunkSize)
+	flag.Var(&chunksize, "chunksize", "size of each upload chunk in bytes, or with a suffix e.g. 8MB. It is rounded down to a multiple of 256KB. A zero value will cause all data to be uploaded in a single request")
+	notifySubscribers := notifyFlag("true")
+	flag.Var(&notifySubscribers, "notify", "notify channel subscribers of new video: 'true', 'false', or 'auto' to only notify them when the video is public or scheduled to be published. Specify '-notify=false' to disable")
+	notifyPolicy := flag.String("notifyPolicy", "all", "when uploading a directory, which videos notify subscribers: 'first', 'last', 'all' or 'none'. -notify=false overrides this")
 	debug := flag.Bool("debug", false, "turn on verbose log output")
+	idleTimeout := flag.Duration("idleTimeout", 0, "abandon an upload request if no data is sent for this long e.g. 1m. Chunks are then retried. Waiting for -ratelimit doesn't count")
+	printUploadID := flag.Bool("printUploadID", false, "print the upload ID of the resumable upload session once it has started")
+	uploadIDFile := flag.String("uploadIDFile", "", "file to write the upload ID of the resumable upload session to, once it has started")
+	maxRetryDuration := flag.Duration("maxRetryDuration", 0, "maximum total time to spend retrying failed chunks of the upload e.g. 30m. By default each chunk is retried for up to 32s")
+	retryLog := flag.String("retryLog", "", "append a line to this file for each upload chunk that is retried")
+	disableHTTP2 := flag.Bool("disableHTTP2", false, "use HTTP/1.1 instead of HTTP/2. Can help when uploads stall behind some proxies")
+	minTLS := flag.String("minTLS", "", "minimum TLS version to use when connecting to Google: '1.2' or '1.3'. Go's default is used if not set")
+	bindAddr := flag.String("bindAddr", "", "local IP address to connect to YouTube from, on machines with more than one network connection")
+	netInterface := flag.String("interface", "", "network interface to connect to YouTube through e.g. eth1. Can't be used together with -bindAddr")
+	metricsAddr := flag.String("metricsAddr", "", "serve Prometheus metrics on this address e.g. ':9090', while youtubeuploader is running")
+	etaSmoothing := flag.Float64("etaSmoothing", limiter.DefaultRateSmoothing, "weight (0-1) given to the latest upload rate when estimating the time remaining. Lower is steadier, 0 uses the average rate")
+	progressWidth := flag.Int("progressWidth", 0, "maximum width of the progress output. Detected from the terminal by default")
+	progressFile := flag.String("progressFile", "", "file to append progress updates to, as lines of JSON")
+	progressFileMaxMB := flag.Int("progressFileMaxMB", 10, "size in MB at which -progressFile is renamed with a .1 suffix and a new file started. 0 disables rotation")
+	progressSocket := flag.String("progressSocket", "", "Unix domain socket to write progress updates to, as lines of JSON")
+	quietErrors := flag.Bool("quietErrors", false, "only output log messages if the upload fails")
+	flag.StringVar(&errorLogFile, "errorLogFile", "", "with -quietErrors, append log messages to this file on failure instead of stderr")
 	sendFileName := flag.Bool("sendFilename", true, "send original file name to YouTube")
+	thumbnailRequired := flag.Bool("thumbnailRequired", false, "fail the run if the thumbnail upload fails, as happens by default, and allow -thumbnailRollback")
+	appendSignature := flag.Bool("appendSignature", false, "append a footer to the video description")
+	signature := flag.String("signature", "Uploaded with youtubeuploader {version} on {date}", "footer text used by -appendSignature. {version} and {date} are replaced")
+	descriptionOverflow := flag.String("descriptionOverflow", "error", "what to do when the description is longer than 5000 bytes: 'error' or 'truncate'")
+	titleOverflow := flag.String("titleOverflow", "error", "what to do when the title is longer than 100 characters: 'error' or 'truncate'")
+	autoThumbnail := flag.Int("autoThumbnail", 0, "after processing completes, upload a copy of one of YouTube's generated thumbnails (1, 2 or 3) as a custom thumbnail. The copy is only 480x360")
+	autoFirstFrame := flag.Bool("autoFirstFrame", false, "when no thumbnail is given, use the first non-black frame of the video. Requires ffmpeg")
+	processingTimeout := flag.Duration("processingTimeout", 30*time.Minute, "how long to wait for YouTube to finish processing the video, when required")
+	captionReplace := flag.Bool("captionReplace", false, "update a caption track already on the video in the same language, rather than adding another")
+	captionConcurrency := flag.Int("captionConcurrency", 1, "maximum number of caption tracks to upload at the same time")
+	locationFromThumbnail := flag.Bool("locationFromThumbnail", false, "set the recording location from the GPS EXIF data of the (JPEG) thumbnail")
+	openURL := flag.String("open", "", "after uploading, open the video's 'watch' or 'studio' page in the browser")
+	confirm := flag.Bool("confirm", false, "show the video metadata and ask for confirmation before uploading")
+	confirmNoTTY := flag.Bool("confirmNoTTY", false, "with -confirm, upload without asking when stdin isn't a terminal. By default the upload fails")
+	interactive := flag.Bool("interactive", false, "choose a playlist from a menu when none is specified. Ignored if stdin is not a terminal")
+	thumbnailRollback := flag.Bool("thumbnailRollback", false, "set the video to private if the thumbnail upload fails. Requires -thumbnailRequired")
+	verifyThumbnail := flag.Bool("verifyThumbnail", false, "after setting the thumbnail, check that YouTube accepted it and warn if not. The API doesn't say whether the video shows a custom thumbnail, so this can't confirm it's used")
+	dumpConfigFile := flag.String("dumpConfig", "", "write the current flags, except per-video metadata, to this file as JSON, which is also valid YAML, then exit")
 
 	flag.Parse()
+
+	if *dumpConfigFile != "" {
+		err = dumpConfig(*dumpConfigFile)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("Configuration written to %q\n", *dumpConfigFile)
+		return
+	}
+
+	if *quietErrors {
+		logBuffer = &utils.LogBuffer{}
+		log.SetOutput(logBuffer)
+	}
+
+	// with -summaryOnly, output written while uploading is discarded, and the summary is written
+	// to the real stdout at the end. Errors are logged to stderr as usual
+	summaryOut := os.Stdout
+	if *summaryOnly {
+		if *confirm {
+			fatal("-summaryOnly can't be used together with -confirm")
+		}
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			fatal(err)
+		}
+		os.Stdout = devNull
+	}
+
+	// temporary files are removed as each video is finished with, and any left over after a
+	// batch of videos or when exiting on an error
+	temp := &yt.TempFiles{Dir: *tempDir, Keep: *keepTemp}
+	cleanups = append(cleanups, temp.RemoveAll)
+
 	config := yt.Config{
 		Filename:          *filename,
 		Thumbnail:         *thumbnail,
@@ -90,18 +296,125 @@ func main() {
 		CategoryId:        *categoryId,
 		Tags:              *tags,
 		Privacy:           *privacy,
-		Quiet:             *quiet,
+		License:           *license,
+		Quiet:             *quiet || *summaryOnly,
 		RateLimit:         *rateLimit,
-		MetaJSON:          *metaJSON,
+		MetaJSON:          metaJSON,
 		MetaJSONOut:       *metaJSONout,
+		FeedFile:          *feedFile,
+		ValidateLanguage:  *validateLanguage,
+		StrictChunksize:   *strictChunksize,
+		ReadBufferSize:    int(readBufferSize),
+		Short:             *short,
 		LimitBetween:      *limitBetween,
 		OAuthPort:         *oAuthPort,
+		TempFiles:         temp,
+		Scopes:            yt.ParseScopes(*scopes),
 		ShowAppVersion:    *showAppVersion,
-		Chunksize:         *chunksize,
-		NotifySubscribers: *notifySubscribers,
+		Chunksize:         int(chunksize),
+		NotifySubscribers: notifySubscribers != "false",
+		NotifyAuto:        notifySubscribers == "auto",
 		SendFileName:      *sendFileName,
 		PlaylistIDs:       playlistIDs,
 		RecordingDate:     recordingDate,
+		PublishAt:         publishAt,
+		ThumbnailRequired: *thumbnailRequired,
+		ThumbnailRollback: *thumbnailRollback,
+		VerifyThumbnail:   *verifyThumbnail,
+		Interactive:       *interactive,
+		AppendSignature:   *appendSignature,
+		Signature:         *signature,
+		AppVersion:        appVersion,
+		AutoThumbnail:     *autoThumbnail,
+		AutoFirstFrame:    *autoFirstFrame,
+		ProcessingTimeout: *processingTimeout,
+
+		CaptionConcurrency: *captionConcurrency,
+		CaptionReplace:     *captionReplace,
+		PlaylistThumbnail:  *playlistThumbnail,
+		MaxRetryDuration:   *maxRetryDuration,
+		StdinFormat:        *stdinFormat,
+		PrintUploadID:      *printUploadID,
+		UploadIDFile:       *uploadIDFile,
+		UploadThenPublic:   *uploadThenPublic,
+		Confirm:            *confirm,
+		OpenURL:            *openURL,
+		ConfirmNoTTY:       *confirmNoTTY,
+
+		LocationFromThumbnail: *locationFromThumbnail,
+		MetaOutConflict:       *metaOutConflict,
+		MetaOutFields:         *metaOutFields,
+		MetaOutIndent:         *metaOutIndent,
+		Watermark:             *watermark,
+		VideoID:               *videoID,
+		DescribeFormat:        *describe,
+		ExportMeta:            *exportMeta,
+		ProgressWidth:         *progressWidth,
+		ProgressSocket:        *progressSocket,
+		ProgressFile:          *progressFile,
+		ProgressFileMaxSize:   int64(*progressFileMaxMB) << 20,
+		InferCategory:         *inferCategory,
+		StateFile:             *stateFile,
+		RecordingDateFromFile: *recordingDateFromFile,
+		FailOnPartialMeta:     *failOnPartialMeta,
+
+		RequireTags:        *requireTags,
+		RequireDescription: *requireDescription,
+		RequireCategory:    *requireCategory,
+		TargetChannel:      *targetChannel,
+		ContentOwner:       *contentOwner,
+
+		NormalizeTitle:      *normalizeTitle,
+		NormalizeTags:       *normalizeTags,
+		LowercaseTags:       *lowercaseTags,
+		ExpandEnv:           *expandEnv,
+		FilenamePattern:     *filenamePattern,
+		ExpandEnvStrict:     *expandEnvStrict,
+		SanitizeTitle:       *sanitizeTitle,
+		SanitizeDescription: *sanitizeDescription,
+
+		DescriptionOverflow: *descriptionOverflow,
+		TitleOverflow:       *titleOverflow,
+	}
+
+	if *preset != "" {
+		config.Preset, err = yt.LoadPreset(*presetsFile, *preset)
+		if err != nil {
+			fatal(err)
+		}
+		// flags set explicitly on the command line take precedence over the preset
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "title":
+				config.Preset.Title = ""
+			case "description":
+				config.Preset.Description = ""
+			case "categoryId":
+				config.Preset.CategoryId = ""
+			case "tags":
+				config.Preset.Tags = nil
+			case "privacy":
+				config.Preset.PrivacyStatus = ""
+			case "license":
+				config.Preset.License = ""
+			case "language":
+				config.Preset.Language = ""
+			case "recordingDate":
+				config.Preset.RecordingDate = yt.Date{}
+			case "publishAt":
+				config.Preset.PublishAt = yt.Date{}
+			}
+		})
+	}
+
+	// the default description doesn't count as one
+	if *requireDescription {
+		config.Description = ""
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "description" {
+				config.Description = *description
+			}
+		})
 	}
 
 	config.Logger = utils.NewLogger(*debug)
@@ -113,43 +426,656 @@ func main() {
 		os.Exit(0)
 	}
 
-	if config.Filename == "" {
+	baseTransport, err := yt.NewTransport(yt.TransportOptions{
+		MinTLS:       *minTLS,
+		DisableHTTP2: *disableHTTP2,
+		BindAddr:     *bindAddr,
+		Interface:    *netInterface,
+	})
+	if err != nil {
+		fatal(err)
+	}
+	// videos at URLs are downloaded with the same network settings as the upload
+	sourceClient := &http.Client{Transport: baseTransport}
+
+	if *dumpToken {
+		err = yt.DumpToken(os.Stdout, "")
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if *listChannels {
+		transport, err := limiter.NewLimitTransport(config.Logger, baseTransport, limiter.LimitRange{}, 0, config.RateLimit)
+		if err != nil {
+			fatal(err)
+		}
+		err = yt.ListChannels(context.Background(), transport, config)
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if config.DescribeFormat != "" || config.ExportMeta != "" {
+		transport, err := limiter.NewLimitTransport(config.Logger, baseTransport, limiter.LimitRange{}, 0, config.RateLimit)
+		if err != nil {
+			fatal(err)
+		}
+		err = yt.Describe(context.Background(), transport, config)
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if config.Watermark != "" {
+		transport, err := limiter.NewLimitTransport(config.Logger, baseTransport, limiter.LimitRange{}, 0, config.RateLimit)
+		if err != nil {
+			fatal(err)
+		}
+		err = yt.SetWatermark(context.Background(), transport, config)
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if *manifestFile != "" && config.Filename != "" {
+		fatal("-manifest can't be used together with -filename")
+	}
+
+	if *watchDir != "" && (config.Filename != "" || *manifestFile != "") {
+		fatal("-watch can't be used together with -filename or -manifest")
+	}
+
+	if *watchDir != "" && *uploadedList == "" {
+		fatal("-watch requires -uploadedList, so videos aren't uploaded again when youtubeuploader is restarted")
+	}
+
+	if config.Filename == "" && *manifestFile == "" && *watchDir == "" {
 		fmt.Printf("\nYou must provide a filename of a video file to upload\n")
 		fmt.Printf("\nUsage:\n")
 		flag.PrintDefaults()
-		os.Exit(1)
+		exit(1)
+	}
+
+	if *checkSourceOnly {
+		if !strings.HasPrefix(config.Filename, "http") {
+			fatal("-checkSourceOnly requires -filename to be a URL")
+		}
+		source, err := yt.CheckSourceWithClient(config.Filename, sourceClient)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("Status:       %s\n", source.Status)
+		fmt.Printf("Size:         %d bytes\n", source.Size)
+		fmt.Printf("Content-Type: %s\n", source.ContentType)
+		if source.StatusCode < 200 || source.StatusCode > 299 {
+			fatal(fmt.Sprintf("%q isn't available: %s", config.Filename, source.Status))
+		}
+		if !source.IsVideo() {
+			fatal(fmt.Sprintf("%q doesn't look like a video", config.Filename))
+		}
+		return
+	}
+
+	var share int
+	if *bandwidthShare != "" {
+		if config.RateLimit > 0 {
+			fatal("-bandwidthShare can't be used together with -ratelimit")
+		}
+		share, err = strconv.Atoi(strings.TrimSuffix(*bandwidthShare, "%"))
+		if err != nil || share < 1 || share > 100 {
+			fatal("-bandwidthShare must be a percentage between 1% and 100%")
+		}
+	}
+
+	if *progressFileMaxMB < 0 {
+		fatal("-progressFileMaxMB can't be negative")
 	}
 
-	if config.Title == "" {
-		config.Title = strings.ReplaceAll(filepath.Base(config.Filename), filepath.Ext(config.Filename), "")
+	var extensions []string
+	for _, ext := range strings.Split(*extensionList, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			extensions = append(extensions, "."+ext)
+		}
+	}
+
+	titleRules, err := yt.ParseTitleCleanup(*titleCleanup)
+	if err != nil {
+		fatal(fmt.Sprintf("Invalid value for -titleCleanup: %v", err))
+	}
+
+	if *thumbnailRollback && !*thumbnailRequired {
+		fatal("-thumbnailRollback requires -thumbnailRequired")
+	}
+
+	if *abortIfExists && *uploadedList == "" {
+		fatal("-abortIfExists requires -uploadedList")
+	}
+	list := yt.UploadedList(*uploadedList)
+
+	switch *notifyPolicy {
+	case "first", "last", "all", "none":
+	default:
+		fatal("-notifyPolicy must be 'first', 'last', 'all' or 'none'")
+	}
+
+	if *partThumbnails {
+		if *splitAt == 0 {
+			fatal("-partThumbnails requires -splitAt")
+		}
+		if *autoThumbnail > 0 {
+			fatal("-partThumbnails can't be used together with -autoThumbnail")
+		}
+	}
+
+	if len(alsoUpload) > 0 && config.Filename == "-" {
+		fatal("-alsoUpload can't be used when reading the video from stdin")
+	}
+
+	// when a directory is given, every video in it is uploaded
+	entries := []yt.ManifestEntry{{Filename: config.Filename}}
+	if *manifestFile != "" {
+		manifest, err := yt.LoadManifest(*manifestFile)
+		if err != nil {
+			fatal(err)
+		}
+		entries = manifest.Videos
+	} else if info, err := os.Stat(config.Filename); err == nil && info.IsDir() {
+		filenames, err := yt.DirectoryVideos(config.Filename, *minFileAge, extensions)
+		if err != nil {
+			fatal(err)
+		}
+		if len(filenames) == 0 {
+			fatal(fmt.Sprintf("no videos found in directory %q", config.Filename))
+		}
+		entries = nil
+		for _, filename := range filenames {
+			entries = append(entries, yt.ManifestEntry{Filename: filename})
+		}
 	}
 
 	var limitRange limiter.LimitRange
 	if config.LimitBetween != "" {
 		limitRange, err = limiter.ParseLimitBetween(config.LimitBetween, inputTimeLayout)
 		if err != nil {
-			fmt.Printf("Invalid value for -limitBetween: %v", err)
-			os.Exit(1)
+			fatal(fmt.Sprintf("Invalid value for -limitBetween: %v", err))
 		}
 	}
 
-	videoReader, filesize, err := yt.Open(config.Filename, yt.VIDEO)
-	if err != nil {
-		log.Fatal(err)
+	var uploadWindow limiter.LimitRange
+	if *uploadBetween != "" {
+		uploadWindow, err = limiter.ParseLimitBetween(*uploadBetween, inputTimeLayout)
+		if err != nil {
+			fatal(fmt.Sprintf("Invalid value for -uploadBetween: %v", err))
+		}
 	}
-	defer videoReader.Close()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// cancel the upload on Ctrl-C, or when a container is being shut down
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	transport, err := limiter.NewLimitTransport(config.Logger, http.DefaultTransport, limitRange, filesize, config.RateLimit)
-	if err != nil {
-		log.Fatal(err)
+	var retryLogFile *os.File
+	if *retryLog != "" {
+		retryLogFile, err = os.OpenFile(*retryLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fatal(err)
+		}
+		defer retryLogFile.Close()
+	}
+
+	var uploadMetrics *metrics.Metrics
+	if *metricsAddr != "" {
+		uploadMetrics = metrics.New()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", uploadMetrics)
+		go func() {
+			err := http.ListenAndServe(*metricsAddr, mux)
+			if err != nil {
+				log.Printf("Error serving metrics: %s", err)
+			}
+		}()
+	}
+
+	// with -manifest or -watch, a failed video doesn't stop the rest. With -manifest, every video's
+	// result is reported at the end
+	keepGoing := *manifestFile != "" || *watchDir != ""
+	var results []string
+	var summaries []uploadSummary
+	failed := false
+	recordFailure := func(filename string, err error) {
+		fmt.Printf("Upload of %q failed: %s\n", filename, err)
+		results = append(results, fmt.Sprintf("%s: failed: %s", filename, err))
+		summaries = append(summaries, uploadSummary{filename: filename, err: err})
+		failed = true
+	}
+
+	// the hooks are run once per video file, however many uploads it took, with the file's own name
+	postFail := func(filename string, err error) {
+		if *postFailCommand == "" {
+			return
+		}
+		hookErr := yt.RunHook(*postFailCommand, "{filename}", filename, "{error}", err.Error())
+		if hookErr != nil {
+			fmt.Printf("WARNING: post fail command: %s\n", hookErr)
+		}
+	}
+
+	videoType := yt.VIDEO
+	if *strictContentType {
+		videoType = yt.STRICT_VIDEO
+	}
+
+	var videoIDs []string
+	uploadEntries := func(entries []yt.ManifestEntry) {
+	entries:
+		for i, entry := range entries {
+			filename := entry.Filename
+			if *abortIfExists {
+				listed, err := list.Contains(filename)
+				if err != nil {
+					fatal(err)
+				}
+				if listed {
+					fmt.Printf("File %q is in the uploaded list %q. Skipping...\n", filename, *uploadedList)
+					results = append(results, fmt.Sprintf("%s: skipped", filename))
+					continue
+				}
+			}
+
+			fileConfig := config
+			fileConfig.Filename = filename
+			fileConfig.Meta = entry.Meta
+			if len(entries) > 1 {
+				fmt.Printf("\nUploading %q\n", filename)
+				switch *notifyPolicy {
+				case "first":
+					fileConfig.NotifySubscribers = config.NotifySubscribers && i == 0
+				case "last":
+					fileConfig.NotifySubscribers = config.NotifySubscribers && i == len(entries)-1
+				case "none":
+					fileConfig.NotifySubscribers = false
+				}
+				// the -thumbnail is used for videos without their own thumbnail alongside them
+				if thumbnail := yt.SidecarThumbnail(filename); thumbnail != "" {
+					fileConfig.Thumbnail = thumbnail
+				}
+			}
+			if entry.Thumbnail != "" {
+				fileConfig.Thumbnail = entry.Thumbnail
+			}
+
+			if fileConfig.Title == "" {
+				fileConfig.Title = yt.TitleFromFilename(filename, titleRules)
+			}
+
+			var cleanup func()
+			if *preprocess != "" {
+				var output string
+				output, cleanup, err = yt.Preprocess(*preprocess, filename, int64(minFreeSpace), temp)
+				if err != nil {
+					postFail(filename, err)
+					if keepGoing {
+						recordFailure(filename, err)
+						continue
+					}
+					fatal(err)
+				}
+				fileConfig.Filename = output
+			}
+
+			parts := []string{fileConfig.Filename}
+			var splitCleanup func()
+			if *splitAt > 0 {
+				parts, splitCleanup, err = yt.SplitVideo(fileConfig.Filename, *splitAt, int64(minFreeSpace), temp)
+				if err != nil {
+					postFail(filename, err)
+					if keepGoing {
+						recordFailure(filename, err)
+						continue
+					}
+					fatal(err)
+				}
+			}
+
+			// the first upload uses the -cache token, followed by one upload per -alsoUpload token
+			cacheFiles := append([]string{""}, alsoUpload...)
+			uploaded := false
+			var videoID string
+			// the file is listed as soon as any of its uploads succeeds, even if a later part or channel
+			// fails, so that it isn't uploaded again when youtubeuploader is restarted
+			recordUploaded := func() {
+				if *uploadedList == "" || !uploaded {
+					return
+				}
+				err := list.Add(filename)
+				if err != nil {
+					fatal(err)
+				}
+			}
+			sharedThumbnail := fileConfig.Thumbnail
+			for p, part := range parts {
+				if len(parts) > 1 {
+					fmt.Printf("\nUploading part %d/%d\n", p+1, len(parts))
+					fileConfig.Filename = part
+					fileConfig.TitleSuffix = fmt.Sprintf(" (Part %d/%d)", p+1, len(parts))
+				}
+				// with -partThumbnails, each part gets a frame from its middle, falling back to the
+				// thumbnail shared by all the parts
+				var thumbnailCleanup func()
+				if *partThumbnails && len(parts) > 1 {
+					var thumbnail string
+					thumbnail, thumbnailCleanup, err = yt.PartThumbnail(part, *splitAt/2, temp)
+					if err != nil {
+						fmt.Printf("WARNING: couldn't extract a thumbnail for part %d: %s\n", p+1, err)
+						fileConfig.Thumbnail = sharedThumbnail
+					} else {
+						fileConfig.Thumbnail = thumbnail
+					}
+				}
+				for _, cacheFile := range cacheFiles {
+					fileConfig.CacheFile = cacheFile
+					if cacheFile != "" {
+						fmt.Printf("\nUploading to the channel authorized by %q\n", cacheFile)
+					}
+
+					// the reader is consumed by the upload, so the file is opened again each time
+					videoReader, filesize, err := yt.OpenWithClient(fileConfig.Filename, videoType, sourceClient)
+					if err != nil {
+						recordUploaded()
+						postFail(filename, err)
+						if keepGoing {
+							recordFailure(filename, err)
+							continue entries
+						}
+						fatal(err)
+					}
+
+					transport, err := limiter.NewLimitTransport(config.Logger, baseTransport, limitRange, filesize, fileConfig.RateLimit)
+					if err != nil {
+						fatal(err)
+					}
+					if retryLogFile != nil {
+						transport.SetRetryLog(retryLogFile)
+					}
+					transport.SetUploadWindow(uploadWindow)
+					err = transport.SetRateSmoothing(*etaSmoothing)
+					if err != nil {
+						fatal(err)
+					}
+					err = transport.SetIdleTimeout(*idleTimeout)
+					if err != nil {
+						fatal(err)
+					}
+					if share > 0 {
+						err = transport.SetBandwidthShare(share, bandwidthProbe)
+						if err != nil {
+							fatal(err)
+						}
+					}
+
+					if uploadMetrics != nil {
+						uploadMetrics.SetTransport(transport)
+					}
+
+					start := time.Now()
+					video, err := yt.Upload(ctx, transport, fileConfig, videoReader)
+					videoReader.Close()
+					if uploadMetrics != nil {
+						uploadMetrics.UploadFinished(err)
+					}
+					if video != nil {
+						videoIDs = append(videoIDs, video.Id)
+						results = append(results, fmt.Sprintf("%s: %s", filename, video.Id))
+						status := transport.GetMonitorStatus()
+						summaries = append(summaries, uploadSummary{
+							filename: filename + fileConfig.TitleSuffix,
+							videoID:  video.Id,
+							bytes:    status.Bytes,
+							elapsed:  time.Since(start),
+							retries:  status.Retries,
+						})
+						if videoID == "" {
+							videoID = video.Id
+						}
+						uploaded = true
+					}
+					if err != nil {
+						recordUploaded()
+						postFail(filename, err)
+						if ctx.Err() != nil {
+							fmt.Printf("\nUpload interrupted. The upload can't be resumed, run youtubeuploader again to restart it\n")
+							fatalWithCode(exitInterrupted, err)
+						}
+						if keepGoing {
+							recordFailure(filename, err)
+							continue entries
+						}
+						fatal(err)
+					}
+				}
+				if thumbnailCleanup != nil {
+					thumbnailCleanup()
+				}
+			}
+
+			recordUploaded()
+
+			if *postUploadCommand != "" && uploaded {
+				err = yt.RunHook(*postUploadCommand, "{filename}", filename, "{videoId}", videoID,
+					"{videoUrl}", "https://www.youtube.com/watch?v="+videoID)
+				if err != nil {
+					err = fmt.Errorf("post upload command: %w", err)
+					if keepGoing {
+						recordFailure(filename, err)
+						continue
+					}
+					fatal(err)
+				}
+			}
+
+			// the file is moved here rather than by yt.Upload, as it may be uploaded to more than one
+			// channel, and with -preprocess it's not the file that was uploaded
+			if *moveAfterUpload != "" && uploaded {
+				moved, err := yt.MoveFile(filename, *moveAfterUpload)
+				if err != nil {
+					fatal(fmt.Errorf("error moving uploaded file: %w", err))
+				}
+				if moved != "" {
+					fmt.Printf("Moved %q to %q\n", filename, moved)
+				}
+			}
+
+			if splitCleanup != nil {
+				splitCleanup()
+			}
+			if cleanup != nil {
+				cleanup()
+			}
+		}
+		// a video that failed may have left temporary files behind
+		temp.RemoveAll()
+	}
+
+	if *watchDir != "" {
+		fmt.Printf("Watching %q for new videos. Press Ctrl-C to stop\n", *watchDir)
+		err = yt.WatchDirectory(ctx, *watchDir, *minFileAge, extensions, func(filenames []string) {
+			var entries []yt.ManifestEntry
+			for _, filename := range filenames {
+				// videos uploaded by an earlier run aren't uploaded again
+				listed, err := list.Contains(filename)
+				if err != nil {
+					fatal(err)
+				}
+				if !listed {
+					entries = append(entries, yt.ManifestEntry{Filename: filename})
+				}
+			}
+			uploadEntries(entries)
+		})
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("\nStopped watching %q\n", *watchDir)
+		if *summaryOnly {
+			printSummary(summaryOut, summaries)
+		}
+		if failed {
+			exit(1)
+		}
+		return
+	}
+
+	uploadEntries(entries)
+
+	if *summaryOnly {
+		printSummary(summaryOut, summaries)
 	}
 
-	err = yt.Run(ctx, transport, config, videoReader)
+	if *manifestFile != "" {
+		fmt.Printf("\nResults:\n")
+		for _, result := range results {
+			fmt.Printf("  %s\n", result)
+		}
+		if failed {
+			exit(1)
+		}
+	} else if len(videoIDs) > 1 {
+		fmt.Printf("\nUploaded video IDs: %s\n", strings.Join(videoIDs, ", "))
+	}
+}
+
+// uploadSummary is an upload reported by -summaryOnly
+type uploadSummary struct {
+	filename string
+	videoID  string
+	bytes    int
+	elapsed  time.Duration
+	retries  int
+	// err is set if the upload failed
+	err error
+}
+
+// printSummary writes one block per upload to w
+func printSummary(w io.Writer, summaries []uploadSummary) {
+	fmt.Fprintf(w, "Upload summary:\n")
+	if len(summaries) == 0 {
+		fmt.Fprintf(w, "  No videos uploaded\n")
+	}
+	for _, s := range summaries {
+		fmt.Fprintf(w, "  %s\n", s.filename)
+		if s.err != nil {
+			fmt.Fprintf(w, "    Failed:   %s\n", s.err)
+			continue
+		}
+		fmt.Fprintf(w, "    Video ID: %s\n", s.videoID)
+		fmt.Fprintf(w, "    URL:      https://www.youtube.com/watch?v=%s\n", s.videoID)
+		fmt.Fprintf(w, "    Size:     %d bytes\n", s.bytes)
+		fmt.Fprintf(w, "    Time:     %s\n", s.elapsed.Round(time.Second))
+		fmt.Fprintf(w, "    Retries:  %d\n", s.retries)
+	}
+}
+
+// localeLanguage returns the language of the user's locale, taken from the LC_ALL, LC_MESSAGES
+// or LANG environment variables e.g. "fr" for LANG=fr_FR.UTF-8. It falls back to "en"
+func localeLanguage() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		locale := os.Getenv(name)
+		if locale == "" {
+			continue
+		}
+		// the first variable set is the one in effect, even if it doesn't name a language
+		lang, _, _ := strings.Cut(locale, "_")
+		lang, _, _ = strings.Cut(lang, ".")
+		lang, _, _ = strings.Cut(lang, "@")
+		if lang == "C" || lang == "POSIX" || len(lang) < 2 || len(lang) > 3 {
+			return "en"
+		}
+		return strings.ToLower(lang)
+	}
+	return "en"
+}
+
+// perVideoFlags describe a single video or action, so aren't included by -dumpConfig
+var perVideoFlags = []string{
+	"filename", "title", "description", "tags", "categoryId", "thumbnail", "caption",
+	"recordingDate", "publishAt", "metaJSON", "metaJSONout", "playlistID", "videoID",
+	"describe", "exportMeta", "manifest", "watch", "checkSourceOnly", "watermark", "listChannels", "dumpToken", "version", "dumpConfig",
+}
+
+// secretFlags aren't included by -dumpConfig, so the file can be shared
+var secretFlags = []string{"token"}
+
+// dumpConfig writes the value of every flag, except perVideoFlags and secretFlags, to filename as a JSON object.
+// Flags that weren't set are included with their default value. JSON is written, rather than YAML, as
+// it's also valid YAML, so the file can be read as either without depending on a YAML library
+func dumpConfig(filename string) error {
+	values := make(map[string]any)
+	flag.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(perVideoFlags, f.Name) || slices.Contains(secretFlags, f.Name) {
+			return
+		}
+		switch v := f.Value.(type) {
+		case *arrayFlags:
+			values[f.Name] = []string(*v)
+		case flag.Getter:
+			switch g := v.Get().(type) {
+			case bool, int:
+				values[f.Name] = g
+			default:
+				values[f.Name] = v.String()
+			}
+		default:
+			values[f.Name] = v.String()
+		}
+	})
+
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filename, append(data, '\n'), 0644)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("error writing config: %w", err)
+	}
+	return nil
+}
+
+// fatal logs the error and exits. With -quietErrors, the buffered log output is written out first
+func fatal(v ...any) {
+	fatalWithCode(1, v...)
+}
+
+// fatalWithCode is like fatal, exiting with the given code
+func fatalWithCode(code int, v ...any) {
+	log.Print(v...)
+	exit(code)
+}
+
+// exit runs the cleanups and exits with code. With -quietErrors, the buffered log output is written
+// out first if code isn't zero
+func exit(code int) {
+	for _, cleanup := range cleanups {
+		cleanup()
+	}
+
+	if logBuffer != nil && code != 0 {
+		var out io.Writer = os.Stderr
+		if errorLogFile != "" {
+			f, err := os.OpenFile(errorLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error opening error log file: %s\n", err)
+			} else {
+				defer f.Close()
+				out = f
+			}
+		}
+		logBuffer.Flush(out)
 	}
 
+	os.Exit(code)
 }
@@ -0,0 +1,29 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package youtubeuploader
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the number of bytes available to unprivileged users in the filesystem containing dir
+func freeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	err := unix.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return max(int64(st.Bavail), 0) * int64(st.Bsize), nil
+}
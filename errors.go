@@ -0,0 +1,115 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package youtubeuploader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Errors returned by Upload and Run can be checked against these with errors.Is
+var (
+	// ErrAuth is an authorization failure, such as an expired token or an account without a channel
+	ErrAuth = errors.New("authorization failed")
+	// ErrQuota is YouTube refusing a request because a quota or upload limit has been reached
+	ErrQuota = errors.New("quota exceeded")
+	// ErrValidation is an invalid Config, or metadata that YouTube rejected
+	ErrValidation = errors.New("validation failed")
+	// ErrUpload is any other failure of a YouTube API call
+	ErrUpload = errors.New("upload failed")
+)
+
+// quotaReasons are the error reasons YouTube gives when a quota or limit has been reached
+var quotaReasons = []string{"quotaExceeded", "uploadLimitExceeded", "rateLimitExceeded", "userRateLimitExceeded", "dailyLimitExceeded"}
+
+// UploadError is returned when a YouTube API call fails. It matches one of ErrAuth, ErrQuota,
+// ErrValidation or ErrUpload with errors.Is, and unwraps to the underlying error e.g. *googleapi.Error
+type UploadError struct {
+	// StatusCode is the HTTP status of the response, or zero if there wasn't one
+	StatusCode int
+	// Reason is the reason YouTube gave for the error e.g. "quotaExceeded", if any
+	Reason string
+
+	kind error
+	err  error
+}
+
+func (e *UploadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *UploadError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// newUploadError classifies err, which is the error from a YouTube API call, as an UploadError
+func newUploadError(err error) *UploadError {
+	e := &UploadError{kind: ErrUpload, err: err}
+
+	var apiErr *googleapi.Error
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &apiErr) {
+		e.StatusCode = apiErr.Code
+		if len(apiErr.Errors) > 0 {
+			e.Reason = apiErr.Errors[0].Reason
+		}
+	} else if errors.As(err, &retrieveErr) {
+		e.kind = ErrAuth
+		if retrieveErr.Response != nil {
+			e.StatusCode = retrieveErr.Response.StatusCode
+		}
+		e.Reason = retrieveErr.ErrorCode
+		return e
+	}
+
+	switch {
+	case slices.Contains(quotaReasons, e.Reason) || e.StatusCode == http.StatusTooManyRequests:
+		e.kind = ErrQuota
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		e.kind = ErrAuth
+	case e.StatusCode == http.StatusBadRequest:
+		e.kind = ErrValidation
+	}
+	return e
+}
+
+// kindError marks err as one of the error kinds, without changing its message
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// validationError marks err as matching ErrValidation
+func validationError(err error) error {
+	return &kindError{kind: ErrValidation, err: err}
+}
+
+// validationErrorf formats an error that matches ErrValidation
+func validationErrorf(format string, args ...any) error {
+	return validationError(fmt.Errorf(format, args...))
+}
@@ -0,0 +1,101 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package youtubeuploader
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxFeedEntries is the number of recent uploads kept in the feed
+const maxFeedEntries = 50
+
+// atomFeed is a minimal Atom feed of uploaded videos, newest first
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title     string   `xml:"title"`
+	ID        string   `xml:"id"`
+	Link      atomLink `xml:"link"`
+	Published string   `xml:"published"`
+	Updated   string   `xml:"updated"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+// addToFeed adds an uploaded video to the Atom feed in filename, creating it if it doesn't exist.
+// Only the most recent maxFeedEntries videos are kept
+func addToFeed(filename, videoID, title string, published time.Time) error {
+	feed := &atomFeed{Title: "Uploaded videos"}
+
+	data, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error reading feed %q: %w", filename, err)
+	}
+	if err == nil {
+		err = xml.Unmarshal(data, feed)
+		if err != nil {
+			return fmt.Errorf("error parsing feed %q: %w", filename, err)
+		}
+	}
+
+	if feed.ID == "" {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			return err
+		}
+		feed.ID = "file://" + filepath.ToSlash(abs)
+	}
+
+	date := published.UTC().Format(time.RFC3339)
+	entry := atomEntry{
+		Title:     title,
+		ID:        "yt:video:" + videoID,
+		Link:      atomLink{Href: "https://www.youtube.com/watch?v=" + videoID},
+		Published: date,
+		Updated:   date,
+	}
+	feed.Entries = append([]atomEntry{entry}, feed.Entries...)
+	if len(feed.Entries) > maxFeedEntries {
+		feed.Entries = feed.Entries[:maxFeedEntries]
+	}
+	feed.Updated = date
+
+	data, err = xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+
+	err = writeFileAtomic(filename, append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("error writing feed %q: %w", filename, err)
+	}
+
+	return nil
+}
@@ -15,17 +15,33 @@ limitations under the License.
 package youtubeuploader
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/porjo/youtubeuploader/internal/utils"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/youtube/v3"
 )
 
@@ -38,6 +54,59 @@ const (
 	VIDEO
 	IMAGE
 	CAPTION
+	// STRICT_VIDEO is a video whose content must clearly be a video. It's rejected
+	// if the type can't be told, rather than a warning being printed
+	STRICT_VIDEO
+)
+
+const (
+	// maximum description length in bytes, as enforced by YouTube
+	maxDescriptionLength = 5000
+	// maximum title length in characters, as enforced by YouTube
+	maxTitleLength = 100
+
+	overflowError    = "error"
+	overflowTruncate = "truncate"
+	ellipsis         = "…"
+
+	// the combined length of the tags is limited by YouTube. Longer individual tags
+	// are likely to be rejected too
+	maxTagsLength = 500
+	maxTagLength  = 100
+
+	// maxShortDuration is the longest video that YouTube treats as a Short
+	maxShortDuration = 3 * time.Minute
+
+	// characters YouTube doesn't allow in titles or descriptions
+	invalidChars = "<>"
+
+	// description placeholder replaced with the chapter list
+	chaptersPlaceholder = "{{CHAPTERS}}"
+
+	// frames with at least blackFramePercent black pixels are skipped when picking the first
+	// frame thumbnail. Only the start of the video is searched
+	blackFramePercent = 98
+	firstFrameSearch  = 60 * time.Second
+
+	conflictOverwrite    = "overwrite"
+	conflictSkip         = "skip"
+	conflictFail         = "fail"
+	conflictAppendSuffix = "append-suffix"
+)
+
+var (
+	// videoExtensions are the files uploaded from a directory
+	videoExtensions = []string{".3gp", ".avi", ".flv", ".m4v", ".mkv", ".mov", ".mp4", ".mpeg", ".mpg", ".ts", ".webm", ".wmv"}
+
+	// videoContentTypes are the content types of videoExtensions, used for StdinFormat
+	videoContentTypes = map[string]string{
+		".3gp": "video/3gpp", ".avi": "video/x-msvideo", ".flv": "video/x-flv", ".m4v": "video/x-m4v",
+		".mkv": "video/x-matroska", ".mov": "video/quicktime", ".mp4": "video/mp4", ".mpeg": "video/mpeg",
+		".mpg": "video/mpeg", ".ts": "video/mp2t", ".webm": "video/webm", ".wmv": "video/x-ms-wmv",
+	}
+
+	// thumbnailExtensions are checked, in order, for a thumbnail alongside each video uploaded from a directory
+	thumbnailExtensions = []string{".jpg", ".jpeg", ".png"}
 )
 
 type Config struct {
@@ -50,9 +119,10 @@ type Config struct {
 	CategoryId        string
 	Tags              string
 	Privacy           string
+	License           string
 	Quiet             bool
 	RateLimit         int
-	MetaJSON          string
+	MetaJSON          []string
 	MetaJSONOut       string
 	LimitBetween      string
 	PlaylistIDs       []string
@@ -62,6 +132,191 @@ type Config struct {
 	NotifySubscribers bool
 	SendFileName      bool
 	RecordingDate     Date
+	PublishAt         Date
+	ThumbnailRequired bool
+	ThumbnailRollback bool
+	VerifyThumbnail   bool
+	Interactive       bool
+	AppendSignature   bool
+	Signature         string
+	AppVersion        string
+	AutoThumbnail     int
+	ProcessingTimeout time.Duration
+
+	// AutoFirstFrame uses the first non-black frame of the video as the thumbnail, when no
+	// other thumbnail is set. It's skipped if ffmpeg isn't installed or the video isn't a local file
+	AutoFirstFrame bool
+
+	// Confirm shows the metadata and asks for confirmation before uploading. When stdin
+	// isn't a terminal, the upload goes ahead if ConfirmNoTTY is set, otherwise it fails
+	Confirm      bool
+	ConfirmNoTTY bool
+
+	// OpenURL opens the uploaded video's "watch" or "studio" page in the browser
+	OpenURL string
+
+	// NotifyAuto limits NotifySubscribers to videos that are public, or scheduled to be published with PublishAt.
+	// A video uploaded with UploadThenPublic counts as public
+	NotifyAuto bool
+
+	// UploadThenPublic uploads the video as private, then makes it public once processing succeeds
+	UploadThenPublic bool
+
+	// CaptionConcurrency is the maximum number of caption tracks uploaded at once
+	CaptionConcurrency int
+
+	// PlaylistThumbnail is an image set as the thumbnail of playlists created for the video
+	PlaylistThumbnail string
+
+	// PrintUploadID prints the upload ID of a resumable upload once the upload session has started,
+	// and UploadIDFile is a file it's written to, for tools that track uploads
+	PrintUploadID bool
+	UploadIDFile  string
+
+	// StdinFormat is the format of a video read from stdin or a pipe, either a file extension e.g. "mp4"
+	// or a content type e.g. "video/mp4". Otherwise YouTube has to work the format out from the video
+	StdinFormat string
+
+	// MaxRetryDuration limits the total time spent retrying chunks of the upload, including the wait
+	// between attempts. Zero leaves each chunk to be retried for up to 32 seconds
+	MaxRetryDuration time.Duration
+
+	// CaptionReplace updates a caption track already on the video in the same language, rather than
+	// adding another track
+	CaptionReplace bool
+
+	// MetaOutConflict sets what happens when MetaJSONOut already exists:
+	// "overwrite" (default), "skip", "fail" or "append-suffix"
+	MetaOutConflict string
+
+	// MetaOutFields sets what's written to MetaJSONOut: "full" (default) writes the video resource
+	// returned by YouTube, "minimal" writes the video ID and the metaJSON fields, in a stable order
+	MetaOutFields string
+
+	// MetaOutIndent is the number of spaces each level of MetaJSONOut is indented by. 0 writes it on one line
+	MetaOutIndent int
+
+	// Preset is a set of metadata defaults, overridden by metaJSON
+	Preset *VideoMeta
+
+	// StrictChunksize makes a Chunksize that isn't a multiple of 256KB an error, rather than
+	// rounding it down
+	StrictChunksize bool
+
+	// ValidateLanguage checks that the language and caption languages are valid BCP-47 codes,
+	// and normalizes their case
+	ValidateLanguage bool
+
+	// FeedFile is an Atom feed that each uploaded video is added to, listing the most recent uploads
+	FeedFile string
+
+	// Meta is metadata in metaJSON format for this video alone, e.g. from a manifest entry.
+	// It overrides the MetaJSON files
+	Meta json.RawMessage
+
+	// LocationFromThumbnail sets the recording location from the thumbnail's EXIF GPS data
+	LocationFromThumbnail bool
+
+	// FilenamePattern is a regular expression matched against the filename. Named groups
+	// (title, description, categoryId, recordingDate, tags) set the corresponding metadata
+	FilenamePattern string
+
+	// ExpandEnv replaces ${VAR} references in the title, description and tags with environment
+	// variables. Undefined variables are left blank, unless ExpandEnvStrict is set which makes them an error
+	ExpandEnv       bool
+	ExpandEnvStrict bool
+
+	// NormalizeTags removes leading '#' characters and surrounding whitespace from tags, and
+	// drops empty tags. With LowercaseTags, they're also converted to lower case
+	NormalizeTags bool
+	LowercaseTags bool
+
+	// NormalizeTitle converts the title to NFC form and strips control and zero-width characters
+	NormalizeTitle bool
+
+	// SanitizeTitle and SanitizeDescription remove characters YouTube rejects
+	SanitizeTitle       bool
+	SanitizeDescription bool
+
+	// TargetChannel is the ID of the channel to upload to. For regular accounts this is
+	// checked against the authorized channel. ContentOwner, if set, uploads on
+	// behalf of the content owner to TargetChannel
+	TargetChannel string
+	ContentOwner  string
+
+	// TempFiles creates the temporary files made while uploading, e.g. by AutoFirstFrame. If nil, they're
+	// created in the OS default directory
+	TempFiles *TempFiles
+
+	// StateFile records the checksums of uploaded files. Files already in the state are skipped
+	StateFile string
+
+	// CacheFile is the OAuth token cache file. If empty, the -cache flag is used
+	CacheFile string
+
+	// Scopes are the OAuth scopes asked for when authorizing, instead of the default ones. They must
+	// include the youtube.upload scope. See ParseScopes
+	Scopes []string
+
+	// InferCategory sets the category, when none is given, to the one used most by recent uploads
+	InferCategory bool
+
+	// ProgressWidth is the maximum length of the progress line. Zero uses the terminal width
+	ProgressWidth int
+
+	// ProgressSocket is a Unix domain socket that progress updates are written to as lines of JSON
+	ProgressSocket string
+
+	// ProgressFile is a file that progress updates are appended to, in the same format as ProgressSocket.
+	// It's rotated once it's larger than ProgressFileMaxSize bytes, unless that's zero
+	ProgressFile        string
+	ProgressFileMaxSize int64
+
+	// ReadBufferSize, if set, is the size of a buffer that the video is read through. A large buffer
+	// reads the source in larger blocks, which can help with fast links. It doesn't change how the
+	// rate limit is applied, as that happens while the upload request is sent
+	ReadBufferSize int
+
+	// Short adds the #Shorts hashtag to the description, and warns if the video won't qualify as a Short
+	Short bool
+
+	// TitleSuffix is appended to the title, e.g. " (Part 1/3)" for a video split into parts
+	TitleSuffix string
+
+	// RequireTags, RequireDescription and RequireCategory fail the upload before it starts
+	// if the video doesn't have tags, a description or a category
+	RequireTags        bool
+	RequireDescription bool
+	RequireCategory    bool
+
+	// FailOnPartialMeta fails the upload before it starts if any thumbnail or caption
+	// files are missing. Otherwise missing files are skipped
+	FailOnPartialMeta bool
+
+	// RecordingDateFromFile sets the recording date, when none is given, from the video's
+	// creation_time tag (using ffprobe, if installed) or the file's modification time
+	RecordingDateFromFile bool
+
+	// VideoID is the existing video used by Describe. DescribeFormat is "human" or "json".
+	// ExportMeta is a file to write the video's metadata to, in metaJSON format
+	VideoID        string
+	DescribeFormat string
+	ExportMeta     string
+
+	// Watermark is the image file used by SetWatermark
+	Watermark string
+
+	// DescriptionOverflow and TitleOverflow set what happens when the description or title
+	// exceeds YouTube's length limits: "error" (default) or "truncate"
+	DescriptionOverflow string
+	TitleOverflow       string
+
+	// HTTPClient, if set, is used for YouTube API requests instead of an OAuth client built from
+	// the token cache. Endpoint overrides the API's base URL e.g. "http://127.0.0.1:8080/".
+	// Together they allow a test server to stand in for YouTube. For the progress and
+	// rate limit to work, HTTPClient should use the LimitTransport passed to Upload
+	HTTPClient *http.Client
+	Endpoint   string
 
 	Logger utils.Logger
 }
@@ -72,6 +327,17 @@ type Date struct {
 	time.Time
 }
 
+// gzipReadCloser decompresses a gzip stream, closing the underlying reader on Close
+type gzipReadCloser struct {
+	*gzip.Reader
+	source   io.Closer
+	filename string
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+var errNoGPS = errors.New("no GPS data found")
+
 func LoadVideoMeta(config Config, video *youtube.Video) (*VideoMeta, error) {
 	videoMeta := &VideoMeta{}
 
@@ -84,76 +350,90 @@ func LoadVideoMeta(config Config, video *youtube.Video) (*VideoMeta, error) {
 	// See: https://github.com/porjo/youtubeuploader/issues/132
 	video.Status.ForceSendFields = []string{"SelfDeclaredMadeForKids"}
 
-	// attempt to load from meta JSON, otherwise use values specified from command line flags
-	if config.MetaJSON != "" {
-		file, e := os.ReadFile(config.MetaJSON)
+	// presets provide defaults that metaJSON can override
+	if config.Preset != nil {
+		videoMeta = config.Preset.clone()
+	}
+
+	// attempt to load from meta JSON, otherwise use values specified from command line flags.
+	// Each file overrides the values of earlier ones, except playlists which are combined
+	for _, metaJSON := range config.MetaJSON {
+		file, e := readFile(metaJSON)
 		if e != nil {
-			e2 := fmt.Errorf("error reading file %q: %w", config.MetaJSON, e)
+			e2 := fmt.Errorf("error reading file %q: %w", metaJSON, e)
 			return nil, e2
 		}
 
-		e = json.Unmarshal(file, &videoMeta)
+		e = mergeVideoMeta(videoMeta, file)
 		if e != nil {
-			e2 := fmt.Errorf("error parsing file %q: %w", config.MetaJSON, e)
+			e2 := fmt.Errorf("error parsing file %q: %w", metaJSON, e)
 			return nil, e2
 		}
+	}
 
-		video.Snippet.Tags = videoMeta.Tags
-		video.Snippet.Title = videoMeta.Title
-		video.Snippet.Description = videoMeta.Description
-		video.Snippet.CategoryId = videoMeta.CategoryId
-		// Location has been deprecated by Google
-		// see: https://developers.google.com/youtube/v3/revision_history#release_notes_06_01_2017
-		/*
-			if videoMeta.Location != nil {
-				video.RecordingDetails.Location = videoMeta.Location
-			}
-			if videoMeta.LocationDescription != "" {
-				video.RecordingDetails.LocationDescription = videoMeta.LocationDescription
-			}
-		*/
-		if !videoMeta.RecordingDate.IsZero() {
-			video.RecordingDetails.RecordingDate = videoMeta.RecordingDate.UTC().Format(ytDateLayout)
+	// per-video metadata, e.g. from a manifest entry, is the last layer
+	if len(config.Meta) > 0 {
+		e := mergeVideoMeta(videoMeta, config.Meta)
+		if e != nil {
+			return nil, fmt.Errorf("error parsing metadata of %q: %w", config.Filename, e)
 		}
+	}
 
-		// status
-		if videoMeta.PrivacyStatus != "" {
-			video.Status.PrivacyStatus = videoMeta.PrivacyStatus
-		}
-		if videoMeta.MadeForKids {
-			video.Status.SelfDeclaredMadeForKids = true
-		}
-		if videoMeta.Embeddable {
-			video.Status.Embeddable = true
-		}
-		if videoMeta.License != "" {
-			video.Status.License = videoMeta.License
+	if config.FilenamePattern != "" {
+		err := applyFilenamePattern(config.FilenamePattern, config.Filename, videoMeta)
+		if err != nil {
+			return nil, err
 		}
-		if videoMeta.PublicStatsViewable {
-			video.Status.PublicStatsViewable = videoMeta.PublicStatsViewable
+	}
+
+	video.Snippet.Tags = videoMeta.Tags
+	video.Snippet.Title = videoMeta.Title
+	video.Snippet.Description = videoMeta.Description
+	video.Snippet.CategoryId = videoMeta.CategoryId
+	// Location has been deprecated by Google
+	// see: https://developers.google.com/youtube/v3/revision_history#release_notes_06_01_2017
+	/*
+		if videoMeta.Location != nil {
+			video.RecordingDetails.Location = videoMeta.Location
 		}
-		if !videoMeta.PublishAt.IsZero() {
-			if video.Status.PrivacyStatus != "private" {
-				fmt.Printf("publishAt can only be used when privacyStatus is 'private'. Ignoring publishAt...\n")
-			} else {
-				if videoMeta.PublishAt.Before(time.Now()) {
-					fmt.Printf("publishAt (%s) was in the past!? Publishing now instead...\n", videoMeta.PublishAt)
-					video.Status.PublishAt = time.Now().UTC().Format(ytDateLayout)
-				} else {
-					video.Status.PublishAt = videoMeta.PublishAt.UTC().Format(ytDateLayout)
-				}
-			}
+		if videoMeta.LocationDescription != "" {
+			video.RecordingDetails.LocationDescription = videoMeta.LocationDescription
 		}
+	*/
+	if !videoMeta.RecordingDate.IsZero() {
+		video.RecordingDetails.RecordingDate = videoMeta.RecordingDate.UTC().Format(ytDateLayout)
+	}
 
-		if videoMeta.Language != "" {
-			video.Snippet.DefaultLanguage = videoMeta.Language
-			video.Snippet.DefaultAudioLanguage = videoMeta.Language
-		}
+	// status
+	if videoMeta.PrivacyStatus != "" {
+		video.Status.PrivacyStatus = videoMeta.PrivacyStatus
+	}
+	if videoMeta.MadeForKids {
+		video.Status.SelfDeclaredMadeForKids = true
+	}
+	if videoMeta.Embeddable {
+		video.Status.Embeddable = true
+	}
+	if videoMeta.License != "" {
+		video.Status.License = videoMeta.License
+	}
+	if videoMeta.PublicStatsViewable {
+		video.Status.PublicStatsViewable = videoMeta.PublicStatsViewable
+	}
+	if videoMeta.Language != "" {
+		video.Snippet.DefaultLanguage = videoMeta.Language
+		video.Snippet.DefaultAudioLanguage = videoMeta.Language
 	}
 
 	if video.Status.PrivacyStatus == "" {
 		video.Status.PrivacyStatus = config.Privacy
 	}
+	if video.Status.License == "" && config.License != "" {
+		video.Status.License = config.License
+	}
+	if video.Status.License != "" && video.Status.License != "youtube" && video.Status.License != "creativeCommon" {
+		return nil, fmt.Errorf("license must be 'youtube' or 'creativeCommon', not %q", video.Status.License)
+	}
 	if video.Snippet.Tags == nil && strings.Trim(config.Tags, "") != "" {
 		video.Snippet.Tags = strings.Split(config.Tags, ",")
 	}
@@ -178,11 +458,187 @@ func LoadVideoMeta(config Config, video *youtube.Video) (*VideoMeta, error) {
 	if video.Snippet.DefaultAudioLanguage == "" && config.Language != "" {
 		video.Snippet.DefaultAudioLanguage = config.Language
 	}
+	if config.ValidateLanguage {
+		for _, lang := range []*string{&video.Snippet.DefaultLanguage, &video.Snippet.DefaultAudioLanguage} {
+			var err error
+			*lang, err = normalizeLanguage(*lang)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(videoMeta.Localizations) > 0 {
+		localizations, err := checkLocalizations(videoMeta.Localizations, video.Snippet.DefaultLanguage, config.ValidateLanguage)
+		if err != nil {
+			return nil, err
+		}
+		video.Localizations = localizations
+	}
 
 	if video.RecordingDetails.RecordingDate == "" && !config.RecordingDate.IsZero() {
 		video.RecordingDetails.RecordingDate = config.RecordingDate.UTC().Format(ytDateLayout)
 	}
 
+	publishAt := videoMeta.PublishAt
+	if publishAt.IsZero() {
+		publishAt = config.PublishAt
+	}
+	if !publishAt.IsZero() {
+		if video.Status.PrivacyStatus != "private" {
+			fmt.Printf("publishAt can only be used when privacyStatus is 'private'. Ignoring publishAt...\n")
+		} else {
+			if publishAt.Before(time.Now()) {
+				fmt.Printf("publishAt (%s) was in the past!? Publishing now instead...\n", publishAt)
+				video.Status.PublishAt = time.Now().UTC().Format(ytDateLayout)
+			} else {
+				video.Status.PublishAt = publishAt.UTC().Format(ytDateLayout)
+			}
+		}
+	}
+
+	if video.RecordingDetails.RecordingDate == "" && config.RecordingDateFromFile {
+		recordingDate, err := fileRecordingDate(config.Filename)
+		if err != nil {
+			config.Logger.Debugf("Not setting recording date from file %q: %s\n", config.Filename, err)
+		} else {
+			fmt.Printf("Setting recording date from file: %s\n", recordingDate.Format(inputDateLayout))
+			video.RecordingDetails.RecordingDate = recordingDate.UTC().Format(ytDateLayout)
+		}
+	}
+
+	if config.LocationFromThumbnail && video.RecordingDetails.Location == nil {
+		location, err := thumbnailLocation(config.Thumbnail)
+		if err != nil {
+			config.Logger.Debugf("Not setting recording location from thumbnail %q: %s\n", config.Thumbnail, err)
+		} else {
+			fmt.Printf("Setting recording location from thumbnail: %f,%f\n", location.Latitude, location.Longitude)
+			video.RecordingDetails.Location = location
+		}
+	}
+
+	if config.ExpandEnv {
+		var errs []error
+		expand := func(s string) string {
+			expanded, err := expandEnv(s, config.ExpandEnvStrict)
+			errs = append(errs, err)
+			return expanded
+		}
+		video.Snippet.Title = expand(video.Snippet.Title)
+		video.Snippet.Description = expand(video.Snippet.Description)
+		for i := range video.Snippet.Tags {
+			video.Snippet.Tags[i] = expand(video.Snippet.Tags[i])
+		}
+		if err := errors.Join(errs...); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.NormalizeTags {
+		video.Snippet.Tags = normalizeTags(video.Snippet.Tags, config.LowercaseTags)
+	}
+	tagsLength := checkTagLengths(video.Snippet.Tags)
+
+	if len(videoMeta.Chapters) > 0 {
+		video.Snippet.Description = insertChapters(video.Snippet.Description, videoMeta.Chapters)
+	}
+
+	// the description is checked before the signature and #Shorts hashtag are added, which
+	// would otherwise hide a missing description
+	if config.RequireDescription && strings.TrimSpace(video.Snippet.Description) == "" {
+		return nil, errors.New("the video has no description, and -requireDescription is set")
+	}
+
+	if config.AppendSignature {
+		video.Snippet.Description = appendSignature(video.Snippet.Description, config.Signature, config.AppVersion)
+	}
+
+	// the Data API has no field for Shorts: YouTube decides from the video's shape and
+	// length, with the #Shorts hashtag as a hint
+	if config.Short {
+		if video.Snippet.Description == "" {
+			video.Snippet.Description = "#Shorts"
+		} else if !shortsTagRegexp.MatchString(video.Snippet.Description) {
+			video.Snippet.Description += "\n\n#Shorts"
+		}
+		checkShort(config.Filename)
+	}
+
+	if config.NormalizeTitle {
+		normalized := normalizeTitle(video.Snippet.Title)
+		if normalized != video.Snippet.Title {
+			fmt.Printf("Normalized title from %+q to %+q\n", video.Snippet.Title, normalized)
+			video.Snippet.Title = normalized
+		}
+	}
+	if config.SanitizeTitle {
+		video.Snippet.Title = sanitize("title", video.Snippet.Title)
+	}
+	if config.SanitizeDescription {
+		video.Snippet.Description = sanitize("description", video.Snippet.Description)
+	}
+
+	var err error
+	video.Snippet.Title, err = limitTitle(video.Snippet.Title, config.TitleSuffix, config.TitleOverflow)
+	if err != nil {
+		return nil, err
+	}
+	video.Snippet.Description, err = limitDescription(video.Snippet.Description, config.DescriptionOverflow)
+	if err != nil {
+		return nil, err
+	}
+
+	// how close the metadata is to YouTube's limits, for information only
+	config.Logger.Debugf("Title: %d of %d characters\n", utf8.RuneCountInString(video.Snippet.Title), maxTitleLength)
+	config.Logger.Debugf("Description: %d of %d bytes\n", len(video.Snippet.Description), maxDescriptionLength)
+	config.Logger.Debugf("Tags: %d tags, %d of %d characters in total\n", len(video.Snippet.Tags), tagsLength, maxTagsLength)
+
+	// with InferCategory, the category is checked once it has been inferred
+	if config.RequireTags && len(video.Snippet.Tags) == 0 {
+		return nil, errors.New("the video has no tags, and -requireTags is set")
+	}
+	if config.RequireCategory && video.Snippet.CategoryId == "" && !config.InferCategory {
+		return nil, errors.New("the video has no category, and -requireCategory is set")
+	}
+
+	if config.Caption != "" {
+		videoMeta.Captions = append([]Caption{{Filename: config.Caption}}, videoMeta.Captions...)
+	}
+
+	// a caption with several languages is uploaded as a separate track for each of them
+	var captions []Caption
+	for _, caption := range videoMeta.Captions {
+		if len(caption.Languages) == 0 {
+			captions = append(captions, caption)
+			continue
+		}
+		var languages []string
+		if caption.Language != "" {
+			languages = append(languages, caption.Language)
+		}
+		for _, language := range appendUnique(languages, caption.Languages...) {
+			track := caption
+			track.Language = language
+			track.Languages = nil
+			captions = append(captions, track)
+		}
+	}
+	videoMeta.Captions = captions
+
+	for i := range videoMeta.Captions {
+		if videoMeta.Captions[i].Language == "" {
+			videoMeta.Captions[i].Language = video.Snippet.DefaultLanguage
+		} else if config.ValidateLanguage {
+			videoMeta.Captions[i].Language, err = normalizeLanguage(videoMeta.Captions[i].Language)
+			if err != nil {
+				return nil, fmt.Errorf("caption %q: %w", videoMeta.Captions[i].Filename, err)
+			}
+		}
+		if videoMeta.Captions[i].Name == "" {
+			videoMeta.Captions[i].Name = videoMeta.Captions[i].Language
+		}
+	}
+
 	// combine cli flag playistIDs and metaJSON playlistIDs. Remove any duplicates
 	playlistIDs := slices.Concat(config.PlaylistIDs, videoMeta.PlaylistIDs)
 	slices.Sort(playlistIDs)
@@ -191,96 +647,1610 @@ func LoadVideoMeta(config Config, video *youtube.Video) (*VideoMeta, error) {
 	return videoMeta, nil
 }
 
-func Open(filename string, mediaType MediaType) (io.ReadCloser, int, error) {
-	var reader io.ReadCloser
-	var filesize int64
-	var err error
-	if strings.HasPrefix(filename, "http") {
-		var resp *http.Response
-		resp, err = http.Head(filename)
-		if err != nil {
-			return reader, 0, fmt.Errorf("error opening %q: %w", filename, err)
+// normalizeTags trims whitespace and leading '#' characters from each tag, optionally
+// converting it to lower case. Tags left empty are removed
+func normalizeTags(tags []string, lowercase bool) []string {
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(tag), "#"))
+		if lowercase {
+			tag = strings.ToLower(tag)
 		}
-		lenStr := resp.Header.Get("content-length")
-		if lenStr != "" {
-			filesize, err = strconv.ParseInt(lenStr, 10, 64)
-			if err != nil {
-				return reader, int(filesize), err
-			}
+		if tag != "" {
+			normalized = append(normalized, tag)
 		}
+	}
+	return normalized
+}
 
-		resp, err = http.Get(filename)
-		if err != nil {
-			return reader, 0, fmt.Errorf("error opening %q: %w", filename, err)
+// checkTagLengths warns about tags that are likely to be rejected for being too long, returning
+// their total length. YouTube counts tags containing spaces as if they were quoted, and a comma between each
+func checkTagLengths(tags []string) int {
+	total := 0
+	for i, tag := range tags {
+		length := utf8.RuneCountInString(tag)
+		if length > maxTagLength {
+			fmt.Printf("WARNING: tag %q is %d characters long, which may be rejected by YouTube\n", tag, length)
 		}
-		// Go doc: When err is nil, resp always contains a non-nil resp.Body. Caller should close resp.Body when done reading from it.
-		defer resp.Body.Close()
-		if resp.ContentLength > 0 {
-			filesize = resp.ContentLength
+		if strings.Contains(tag, " ") {
+			length += 2
 		}
-		reader = resp.Body
-	} else if filename == "-" {
-		reader = os.Stdin
-	} else {
-		var file *os.File
-		var fileInfo os.FileInfo
-		file, err = os.Open(filename)
-		if err != nil {
-			return reader, 0, fmt.Errorf("error opening %q: %w", filename, err)
+		if i > 0 {
+			length++
 		}
+		total += length
+	}
+	if total > maxTagsLength {
+		fmt.Printf("WARNING: the tags are %d characters long in total, more than YouTube's limit of %d\n", total, maxTagsLength)
+	}
+	return total
+}
 
-		fileInfo, err = file.Stat()
-		if err != nil {
-			return reader, 0, fmt.Errorf("error stat'ing %q: %w", filename, err)
+// sanitize removes characters that YouTube rejects from s, printing what was removed.
+// field is the name of the field being sanitized
+func sanitize(field, s string) string {
+	var removed []string
+	clean := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(invalidChars, r) {
+			removed = append(removed, string(r))
+			return -1
 		}
+		return r
+	}, s)
 
-		// check the file looks like the media type it is supposed to be
-		buf := make([]byte, 512)
-		_, err = file.Read(buf)
-		if err != nil {
-			return reader, 0, fmt.Errorf("error reading %q: %w", filename, err)
+	if len(removed) > 0 {
+		fmt.Printf("Removed invalid characters from %s: %q\n", field, strings.Join(removed, ""))
+	}
+	return clean
+}
+
+// checkMedia checks that the thumbnail, playlist thumbnail and caption files exist. If config.FailOnPartialMeta is set,
+// an error listing all of the missing files is returned. Otherwise the missing files are
+// dropped with a warning. Only local files are checked
+func checkMedia(config *Config, videoMeta *VideoMeta) error {
+	var errs []error
+
+	if err := mediaExists(config.Thumbnail); err != nil {
+		errs = append(errs, fmt.Errorf("thumbnail: %w", err))
+		if !config.FailOnPartialMeta {
+			fmt.Printf("WARNING: thumbnail %q will not be uploaded: %s\n", config.Thumbnail, err)
+			config.Thumbnail = ""
 		}
-		_, err = file.Seek(0, 0)
-		if err != nil {
-			return reader, 0, fmt.Errorf("error reading %q: %w", filename, err)
+	}
+
+	if err := mediaExists(config.PlaylistThumbnail); err != nil {
+		errs = append(errs, fmt.Errorf("playlist thumbnail: %w", err))
+		if !config.FailOnPartialMeta {
+			fmt.Printf("WARNING: playlist thumbnail %q will not be uploaded: %s\n", config.PlaylistThumbnail, err)
+			config.PlaylistThumbnail = ""
 		}
-		contentType := http.DetectContentType(buf)
-		switch mediaType {
-		case VIDEO:
-			if !strings.HasPrefix(contentType, "video") && contentType != "application/octet-stream" {
-				fmt.Printf("WARNING: input file %q doesn't appear to be a video. It has content type %q\n", filename, contentType)
+	}
+
+	var captions []Caption
+	for _, c := range videoMeta.Captions {
+		if err := mediaExists(c.Filename); err != nil {
+			errs = append(errs, fmt.Errorf("caption: %w", err))
+			if !config.FailOnPartialMeta {
+				fmt.Printf("WARNING: caption %q will not be uploaded: %s\n", c.Filename, err)
 			}
-		case IMAGE:
-			if !strings.HasPrefix(contentType, "image") && contentType != "application/octet-stream" {
-				fmt.Printf("WARNING: input file %q doesn't appear to be an image. It has content type %q\n", filename, contentType)
+			continue
+		}
+		captions = append(captions, c)
+	}
+	videoMeta.Captions = captions
+
+	if config.FailOnPartialMeta && len(errs) > 0 {
+		return fmt.Errorf("missing media files:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// mediaExists returns an error if filename is a local file that can't be read
+func mediaExists(filename string) error {
+	if filename == "" || filename == "-" || strings.HasPrefix(filename, "http") {
+		return nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// fileRecordingDate returns the creation time recorded in the video file's metadata,
+// falling back to the file's modification time
+func fileRecordingDate(filename string) (time.Time, error) {
+	if !isRegularFile(filename) {
+		return time.Time{}, fmt.Errorf("only local files have a recording date")
+	}
+
+	if ffprobe, err := exec.LookPath("ffprobe"); err == nil {
+		out, err := exec.Command(ffprobe, "-v", "quiet", "-show_entries", "format_tags=creation_time",
+			"-of", "default=noprint_wrappers=1:nokey=1", filename).Output()
+		if err == nil {
+			t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(out)))
+			if err == nil {
+				return t, nil
 			}
 		}
+	}
 
-		reader = file
-		filesize = fileInfo.Size()
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
 
+// checkShort warns if the video won't be treated as a Short, because it's wider than it is tall
+// or longer than maxShortDuration. It's only checked for local files, when ffprobe is installed
+func checkShort(filename string) {
+	if !isRegularFile(filename) {
+		return
+	}
+	ffprobe, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return
+	}
+	out, err := exec.Command(ffprobe, "-v", "quiet", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height:stream_side_data=rotation:format=duration", "-of", "json", filename).Output()
+	if err != nil {
+		return
+	}
+
+	var probe struct {
+		Streams []struct {
+			Width        int `json:"width"`
+			Height       int `json:"height"`
+			SideDataList []struct {
+				Rotation int `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if json.Unmarshal(out, &probe) != nil || len(probe.Streams) == 0 {
+		return
+	}
+
+	stream := probe.Streams[0]
+	width, height := stream.Width, stream.Height
+	for _, sideData := range stream.SideDataList {
+		// phones often record landscape frames, rotated for playback
+		if sideData.Rotation%180 != 0 {
+			width, height = height, width
+		}
+	}
+	if width > height {
+		fmt.Printf("WARNING: the video is %dx%d. Shorts must be vertical or square, so it won't be a Short\n", width, height)
+	}
+	if seconds, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		duration := time.Duration(seconds * float64(time.Second))
+		if duration > maxShortDuration {
+			fmt.Printf("WARNING: the video is %s long. Shorts can be up to %s, so it won't be a Short\n",
+				duration.Round(time.Second), maxShortDuration)
+		}
 	}
-	return reader, int(filesize), err
 }
 
-func (d *Date) UnmarshalJSON(b []byte) (err error) {
-	s := string(b)
-	s = s[1 : len(s)-1]
-	err = d.parse(s)
-	return
+// normalizeTitle converts title to Unicode NFC form, removing control characters and
+// invisible formatting characters such as zero-width spaces and direction marks.
+// Zero-width joiners are kept, as they're part of some emoji
+func normalizeTitle(title string) string {
+	title = strings.Map(func(r rune) rune {
+		if r != '\u200d' && (unicode.IsControl(r) || unicode.Is(unicode.Cf, r)) {
+			return -1
+		}
+		return r
+	}, title)
+	return norm.NFC.String(title)
 }
 
-func (d *Date) Set(s string) (err error) {
-	err = d.parse(s)
-	return
+// shortsTagRegexp matches the #Shorts hashtag in any case
+var shortsTagRegexp = regexp.MustCompile(`(?i)#shorts\b`)
+
+// envVarRegexp matches ${VAR} references. $VAR isn't supported as '$' is common in descriptions e.g. prices
+var envVarRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} references in s with the value of the environment variable.
+// Undefined variables are replaced with an empty string, or if strict is set, cause an error
+func expandEnv(s string, strict bool) (string, error) {
+	var undefined []string
+	expanded := envVarRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envVarRegexp.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			undefined = append(undefined, name)
+		}
+		return value
+	})
+
+	if strict && len(undefined) > 0 {
+		return s, fmt.Errorf("undefined environment variables: %s", strings.Join(undefined, ", "))
+	}
+	return expanded, nil
 }
 
-func (d *Date) parse(s string) (err error) {
-	// support ISO 8601 date only, and date + time
-	if strings.ContainsAny(s, ":") {
-		d.Time, err = time.Parse(inputDatetimeLayout, s)
-	} else {
-		d.Time, err = time.Parse(inputDateLayout, s)
+// Preprocess runs command on the input file before it's uploaded. The command must include
+// the {input} and {output} placeholders, which are replaced with the input filename and the name
+// of a temporary output file. The output filename is returned, along with a function that
+// removes the temporary files, which are created with temp. There must be room in the temporary
+// directory for an output file as large as the input, with minFreeSpace bytes to spare
+func Preprocess(command, input string, minFreeSpace int64, temp *TempFiles) (string, func(), error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid preprocess command: %w", err)
 	}
-	return
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("preprocess command is empty")
+	}
+	if !strings.Contains(command, "{input}") || !strings.Contains(command, "{output}") {
+		return "", nil, fmt.Errorf("preprocess command must contain {input} and {output}")
+	}
+	program, err := exec.LookPath(args[0])
+	if err != nil {
+		return "", nil, fmt.Errorf("preprocess command: %w", err)
+	}
+
+	need := minFreeSpace
+	if info, err := os.Stat(input); err == nil && info.Mode().IsRegular() {
+		need += info.Size()
+	}
+	err = checkFreeSpace(temp.root(), need)
+	if err != nil {
+		return "", nil, fmt.Errorf("preprocess: %w", err)
+	}
+
+	dir, cleanup, err := temp.MkdirTemp()
+	if err != nil {
+		return "", nil, err
+	}
+
+	// keep the original name, so it's still correct when sent to YouTube
+	name := filepath.Base(input)
+	if input == "-" || strings.HasPrefix(input, "http") {
+		name = "video.mp4"
+	}
+	output := filepath.Join(dir, name)
+
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{input}", input)
+		args[i] = strings.ReplaceAll(args[i], "{output}", output)
+	}
+
+	fmt.Printf("Preprocessing %q...\n", input)
+	cmd := exec.Command(program, args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if input == "-" {
+		cmd.Stdin = os.Stdin
+	}
+	err = cmd.Run()
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("preprocess command failed: %w", err)
+	}
+	if _, err := os.Stat(output); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("preprocess command didn't create {output}: %w", err)
+	}
+
+	return output, cleanup, nil
+}
+
+// normalizeLanguage checks that code is a well-formed BCP-47 language tag, and returns it with
+// the conventional case e.g. "en-US". Deprecated codes are left as they are, as YouTube uses some
+func normalizeLanguage(code string) (string, error) {
+	if code == "" {
+		return "", nil
+	}
+	tag, err := language.Raw.Parse(code)
+	if err != nil {
+		return "", fmt.Errorf("invalid language code %q: %w", code, err)
+	}
+	return tag.String(), nil
+}
+
+// mergeVideoMeta applies a layer of metadata in metaJSON format over videoMeta.
+// Fields in the layer override earlier values, except playlists which are combined
+func mergeVideoMeta(videoMeta *VideoMeta, data []byte) error {
+	prev := videoMeta.clone()
+	err := json.Unmarshal(data, videoMeta)
+	if err != nil {
+		return err
+	}
+
+	// the merged playlists were overwritten, so get the ones from this layer alone
+	var layer VideoMeta
+	_ = json.Unmarshal(data, &layer)
+	videoMeta.PlaylistIDs = appendUnique(prev.PlaylistIDs, layer.PlaylistIDs...)
+	videoMeta.PlaylistTitles = appendUnique(prev.PlaylistTitles, layer.PlaylistTitles...)
+	return nil
+}
+
+// checkLocalizations converts localizations to the form used by the YouTube API. Each one must have a title
+// and description, and the video must have a language, which YouTube uses to pick the localization shown by
+// default. A localization for that language would be ambiguous, so it's dropped with a warning
+func checkLocalizations(localizations map[string]Localization, defaultLanguage string, validate bool) (map[string]youtube.VideoLocalization, error) {
+	if defaultLanguage == "" {
+		return nil, errors.New("a video with localizations must have a language, for the default title and description")
+	}
+
+	// sorted, so that errors and warnings are in a stable order
+	languages := make([]string, 0, len(localizations))
+	for lang := range localizations {
+		languages = append(languages, lang)
+	}
+	slices.Sort(languages)
+
+	converted := make(map[string]youtube.VideoLocalization)
+	for _, lang := range languages {
+		localization := localizations[lang]
+		if strings.TrimSpace(localization.Title) == "" {
+			return nil, fmt.Errorf("localization %q has no title", lang)
+		}
+		if strings.TrimSpace(localization.Description) == "" {
+			return nil, fmt.Errorf("localization %q has no description", lang)
+		}
+		if validate {
+			var err error
+			lang, err = normalizeLanguage(lang)
+			if err != nil {
+				return nil, fmt.Errorf("localization: %w", err)
+			}
+		}
+		if strings.EqualFold(lang, defaultLanguage) {
+			fmt.Printf("WARNING: localization %q is the video's language, so the video's own title and description are used for it\n", lang)
+			continue
+		}
+		converted[lang] = youtube.VideoLocalization{
+			Title:       localization.Title,
+			Description: localization.Description,
+		}
+	}
+	return converted, nil
+}
+
+// checkFreeSpace returns an error if the filesystem containing dir has less than need bytes free.
+// If the free space can't be found, it's assumed to be enough
+func checkFreeSpace(dir string, need int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return nil
+	}
+	if free < need {
+		return fmt.Errorf("not enough free space in %q: %d MB needed, %d MB available", dir, need>>20, free>>20)
+	}
+	return nil
+}
+
+// firstFrameThumbnail extracts the first frame of the video that isn't mostly black, using ffmpeg.
+// Only the first firstFrameSearch of the video is searched, falling back to the very first frame.
+// The JPEG's filename is returned, along with a function that removes it
+func firstFrameThumbnail(filename string, temp *TempFiles) (string, func(), error) {
+	if !isRegularFile(filename) {
+		return "", nil, errors.New("only local files can be read by ffmpeg")
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, cleanup, err := temp.MkdirTemp()
+	if err != nil {
+		return "", nil, err
+	}
+	output := filepath.Join(dir, "thumbnail.jpg")
+
+	// blackframe reports the percentage of black pixels in every frame (amount=0),
+	// and frames that are mostly black are then dropped
+	filters := []string{
+		fmt.Sprintf("blackframe=amount=0,metadata=select:key=lavfi.blackframe.pblack:value=%d:function=less", blackFramePercent),
+		"null",
+	}
+	for _, filter := range filters {
+		err = exec.Command(ffmpeg, "-v", "error", "-t", strconv.Itoa(int(firstFrameSearch.Seconds())), "-i", filename,
+			"-vf", filter, "-frames:v", "1", "-q:v", "2", "-y", output).Run()
+		if err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("ffmpeg failed: %w", err)
+		}
+		if _, err := os.Stat(output); err == nil {
+			return output, cleanup, nil
+		}
+	}
+
+	cleanup()
+	return "", nil, errors.New("ffmpeg didn't extract a frame")
+}
+
+// PartThumbnail extracts the frame at offset into the video as a JPEG thumbnail using ffmpeg, to give
+// each part of a split video its own thumbnail. If the video is shorter than offset, its first non-black
+// frame is used instead. The JPEG's filename is returned, along with a function that removes it.
+// It's written to a directory created with temp
+func PartThumbnail(filename string, offset time.Duration, temp *TempFiles) (string, func(), error) {
+	if !isRegularFile(filename) {
+		return "", nil, errors.New("only local files can be read by ffmpeg")
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, cleanup, err := temp.MkdirTemp()
+	if err != nil {
+		return "", nil, err
+	}
+	output := filepath.Join(dir, "thumbnail.jpg")
+
+	// seeking past the end isn't an error, ffmpeg just doesn't write a frame
+	err = exec.Command(ffmpeg, "-v", "error", "-ss", strconv.FormatFloat(offset.Seconds(), 'f', -1, 64), "-i", filename,
+		"-frames:v", "1", "-q:v", "2", "-y", output).Run()
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	if _, err := os.Stat(output); err == nil {
+		return output, cleanup, nil
+	}
+
+	cleanup()
+	return firstFrameThumbnail(filename, temp)
+}
+
+// SplitVideo splits a local video into parts of about partLength using ffmpeg, without re-encoding.
+// Parts are cut at the first keyframe after each partLength, so they can be played on their own.
+// The part filenames are returned in order, along with a function that removes them. A video no
+// longer than partLength isn't split, and its own filename is returned. There must be room in the
+// temporary directory created with temp for the parts, with minFreeSpace bytes to spare
+func SplitVideo(filename string, partLength time.Duration, minFreeSpace int64, temp *TempFiles) ([]string, func(), error) {
+	if !isRegularFile(filename) {
+		return nil, nil, errors.New("only local files can be split")
+	}
+	if partLength < time.Second {
+		return nil, nil, errors.New("parts must be at least 1 second long")
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, nil, fmt.Errorf("splitting a video requires ffmpeg: %w", err)
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = checkFreeSpace(temp.root(), info.Size()+minFreeSpace)
+	if err != nil {
+		return nil, nil, fmt.Errorf("split: %w", err)
+	}
+
+	dir, cleanup, err := temp.MkdirTemp()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fmt.Printf("Splitting %q into parts of %s...\n", filename, partLength)
+	pattern := filepath.Join(dir, "part%03d"+filepath.Ext(filename))
+	cmd := exec.Command(ffmpeg, "-v", "error", "-i", filename, "-map", "0", "-c", "copy",
+		"-f", "segment", "-segment_time", strconv.FormatFloat(partLength.Seconds(), 'f', -1, 64),
+		"-reset_timestamps", "1", pattern)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("ffmpeg failed: %w", err)
+	}
+
+	parts, err := filepath.Glob(filepath.Join(dir, "part*"))
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if len(parts) == 0 {
+		cleanup()
+		return nil, nil, errors.New("ffmpeg didn't write any parts")
+	}
+	if len(parts) == 1 {
+		cleanup()
+		return []string{filename}, func() {}, nil
+	}
+	slices.Sort(parts)
+
+	return parts, cleanup, nil
+}
+
+// RunHook runs command, replacing placeholders in its arguments. placeholders are pairs of placeholder
+// and value, as for strings.NewReplacer. The command's output is printed once it has finished
+func RunHook(command string, placeholders ...string) error {
+	args, err := splitCommand(command)
+	if err != nil {
+		return fmt.Errorf("invalid command: %w", err)
+	}
+	if len(args) == 0 {
+		return errors.New("command is empty")
+	}
+	// a single pass, so that values containing placeholders aren't expanded again
+	replacer := strings.NewReplacer(placeholders...)
+	for i := range args {
+		args[i] = replacer.Replace(args[i])
+	}
+
+	fmt.Printf("Running %q...\n", args[0])
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if len(out) > 0 {
+		fmt.Printf("%s", out)
+		if out[len(out)-1] != '\n' {
+			fmt.Println()
+		}
+	}
+	return err
+}
+
+// splitCommand splits a command line into arguments. Arguments containing spaces can be
+// quoted with single or double quotes, or the spaces escaped with a backslash
+func splitCommand(command string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range command {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
+
+// applyFilenamePattern matches the regular expression pattern against the filename (without
+// directory or extension), setting any empty fields of videoMeta from named groups. The group
+// names are title, description, categoryId, recordingDate and tags (comma separated)
+func applyFilenamePattern(pattern, filename string, videoMeta *VideoMeta) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid filename pattern: %w", err)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	match := re.FindStringSubmatch(name)
+	if match == nil {
+		fmt.Printf("WARNING: filename %q doesn't match the filename pattern\n", name)
+		return nil
+	}
+
+	for i, group := range re.SubexpNames() {
+		value := strings.TrimSpace(match[i])
+		if group == "" || value == "" {
+			continue
+		}
+		switch group {
+		case "title":
+			if videoMeta.Title == "" {
+				videoMeta.Title = value
+			}
+		case "description":
+			if videoMeta.Description == "" {
+				videoMeta.Description = value
+			}
+		case "categoryId":
+			if videoMeta.CategoryId == "" {
+				videoMeta.CategoryId = value
+			}
+		case "recordingDate":
+			if videoMeta.RecordingDate.IsZero() {
+				err := videoMeta.RecordingDate.parse(value)
+				if err != nil {
+					return fmt.Errorf("invalid recordingDate %q from filename: %w", value, err)
+				}
+			}
+		case "tags":
+			if videoMeta.Tags == nil {
+				for _, tag := range strings.Split(value, ",") {
+					if tag = strings.TrimSpace(tag); tag != "" {
+						videoMeta.Tags = append(videoMeta.Tags, tag)
+					}
+				}
+			}
+		default:
+			return fmt.Errorf("unknown group %q in filename pattern", group)
+		}
+	}
+
+	return nil
+}
+
+// titleCleanupRules are the rules accepted by -titleCleanup, in the order they're applied
+var titleCleanupRules = []string{"prefix", "spaces", "titlecase"}
+
+// titlePrefixRegexp matches a leading date, date and time, or sequence number e.g. "2024-05-01_",
+// "20240501-1830 " or "03 - ", followed by separators
+var titlePrefixRegexp = regexp.MustCompile(`^(\d{4}[-_.]?\d{2}[-_.]?\d{2}([T_ -]?\d{2}[-_.:h]?\d{2}([-_.:m]?\d{2}s?)?)?|\d{1,3})[-_.\s]+`)
+
+// ParseTitleCleanup parses a comma separated list of title cleanup rules: prefix, spaces and titlecase,
+// or all. An empty string means no cleanup
+func ParseTitleCleanup(s string) ([]string, error) {
+	var rules []string
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		switch {
+		case rule == "":
+		case rule == "all":
+			rules = append(rules, titleCleanupRules...)
+		case slices.Contains(titleCleanupRules, rule):
+			rules = append(rules, rule)
+		default:
+			return nil, fmt.Errorf("unknown title cleanup rule %q, must be one of %s or all", rule, strings.Join(titleCleanupRules, ", "))
+		}
+	}
+	return rules, nil
+}
+
+// ParseScopes parses a comma separated list of OAuth scopes. Google API scopes can be given by name
+// e.g. "youtube.upload" for "https://www.googleapis.com/auth/youtube.upload"
+func ParseScopes(s string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !strings.Contains(scope, "://") {
+			scope = scopePrefix + scope
+		}
+		scopes = appendUnique(scopes, scope)
+	}
+	return scopes
+}
+
+// TitleFromFilename returns a title made from the filename, without its directory or extension, cleaned up
+// by the rules from ParseTitleCleanup:
+//   - prefix strips a leading date or sequence number
+//   - spaces replaces underscores and dots with spaces
+//   - titlecase capitalizes the first letter of each word
+func TitleFromFilename(filename string, rules []string) string {
+	title := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+
+	// the rules are applied in a fixed order, whatever order they were given in
+	if slices.Contains(rules, "prefix") {
+		// a name that's only a date is left alone, rather than leaving no title
+		if stripped := titlePrefixRegexp.ReplaceAllString(title, ""); stripped != "" {
+			title = stripped
+		}
+	}
+	if slices.Contains(rules, "spaces") {
+		title = strings.Join(strings.Fields(strings.NewReplacer("_", " ", ".", " ").Replace(title)), " ")
+	}
+	if slices.Contains(rules, "titlecase") {
+		runes := []rune(title)
+		for i, r := range runes {
+			if i == 0 || unicode.IsSpace(runes[i-1]) {
+				runes[i] = unicode.ToTitle(r)
+			}
+		}
+		title = string(runes)
+	}
+	return title
+}
+
+// appendUnique appends the values that aren't already in s
+func appendUnique(s []string, values ...string) []string {
+	for _, v := range values {
+		if !slices.Contains(s, v) {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// insertChapters renders chapters one per line, replacing the chapters placeholder
+// in description. If there is no placeholder, the chapters are appended
+func insertChapters(description string, chapters []Chapter) string {
+	lines := make([]string, len(chapters))
+	for i, c := range chapters {
+		lines[i] = c.Start + " " + c.Title
+	}
+	rendered := strings.Join(lines, "\n")
+
+	if strings.Contains(description, chaptersPlaceholder) {
+		return strings.ReplaceAll(description, chaptersPlaceholder, rendered)
+	}
+	if description == "" {
+		return rendered
+	}
+	return description + "\n\n" + rendered
+}
+
+// Open opens the media file, which may be a URL or "-" for stdin, returning it along with its size if known
+func Open(filename string, mediaType MediaType) (io.ReadCloser, int, error) {
+	return OpenWithClient(filename, mediaType, nil)
+}
+
+// OpenWithClient is like Open, fetching URLs with client, or http.DefaultClient if it's nil
+func OpenWithClient(filename string, mediaType MediaType, client *http.Client) (io.ReadCloser, int, error) {
+	var reader io.ReadCloser
+	var filesize int64
+	var err error
+	if strings.HasPrefix(filename, "http") {
+		if isYouTubePageURL(filename) {
+			return reader, 0, fmt.Errorf("%q is a YouTube page, not a media file. Download the video first and upload the downloaded file", filename)
+		}
+		var source *Source
+		source, err = CheckSourceWithClient(filename, client)
+		if err != nil {
+			return reader, 0, err
+		}
+		filesize = source.Size
+		if mediaType == STRICT_VIDEO {
+			contentType, _, _ := strings.Cut(source.ContentType, ";")
+			if !strings.HasPrefix(strings.TrimSpace(contentType), "video/") {
+				return reader, 0, fmt.Errorf("%q doesn't appear to be a video. It has content type %q", filename, source.ContentType)
+			}
+		}
+
+		var resp *http.Response
+		resp, err = sourceClient(client).Get(filename)
+		if err != nil {
+			return reader, 0, fmt.Errorf("error opening %q: %w", filename, err)
+		}
+		// the body is returned for the caller to read and close
+		if resp.ContentLength > 0 {
+			filesize = resp.ContentLength
+		}
+		reader = resp.Body
+	} else if filename == "-" {
+		if mediaType == STRICT_VIDEO {
+			return reader, 0, fmt.Errorf("the content type of a video read from stdin can't be checked")
+		}
+		reader = os.Stdin
+	} else {
+		var file *os.File
+		var fileInfo os.FileInfo
+		file, err = os.Open(filename)
+		if err != nil {
+			return reader, 0, fmt.Errorf("error opening %q: %w", filename, err)
+		}
+
+		fileInfo, err = file.Stat()
+		if err != nil {
+			return reader, 0, fmt.Errorf("error stat'ing %q: %w", filename, err)
+		}
+
+		// pipes and devices are read like stdin: they can't be seeked back
+		// after checking the content type, and their size is unknown
+		if fileInfo.Mode().IsRegular() {
+			err = checkContentType(file, filename, mediaType)
+			if err != nil {
+				file.Close()
+				return reader, 0, err
+			}
+			filesize = fileInfo.Size()
+		} else if mediaType == STRICT_VIDEO {
+			file.Close()
+			return reader, 0, fmt.Errorf("the content type of %q can't be checked, as it isn't a regular file", filename)
+		}
+
+		reader = file
+
+	}
+
+	if mediaType == CAPTION {
+		var gzipped bool
+		reader, gzipped, err = gunzip(filename, reader)
+		if err != nil {
+			return reader, 0, err
+		}
+		if gzipped {
+			// decompressed size is unknown
+			filesize = 0
+		}
+	}
+
+	return reader, int(filesize), err
+}
+
+// Source describes a video at a URL, as reported by the server
+type Source struct {
+	// Status is the HTTP status of the response e.g. "200 OK"
+	Status     string
+	StatusCode int
+
+	// Size is the length of the video in bytes, or zero if the server didn't give it
+	Size        int64
+	ContentType string
+}
+
+// IsVideo reports whether the content type is one that a video could be sent as
+func (s *Source) IsVideo() bool {
+	mediaType, _, _ := strings.Cut(s.ContentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	return strings.HasPrefix(mediaType, "video/") || mediaType == "application/octet-stream"
+}
+
+// CheckSource makes a HEAD request for the URL, without downloading it, and returns its size and
+// content type. An error status isn't an error here, as some servers don't support HEAD requests
+func CheckSource(url string) (*Source, error) {
+	return CheckSourceWithClient(url, nil)
+}
+
+// CheckSourceWithClient is like CheckSource, making the request with client, or http.DefaultClient if it's nil
+func CheckSourceWithClient(url string, client *http.Client) (*Source, error) {
+	resp, err := sourceClient(client).Head(url)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %q: %w", url, err)
+	}
+	resp.Body.Close()
+
+	source := &Source{
+		Status:      resp.Status,
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	lenStr := resp.Header.Get("content-length")
+	if lenStr != "" {
+		source.Size, err = strconv.ParseInt(lenStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content length for %q: %w", url, err)
+		}
+	}
+	return source, nil
+}
+
+// sourceClient returns client, or http.DefaultClient if it's nil
+func sourceClient(client *http.Client) *http.Client {
+	if client == nil {
+		return http.DefaultClient
+	}
+	return client
+}
+
+// checkContentType warns if the file doesn't look like the media type it is supposed to be, or
+// for STRICT_VIDEO returns an error. The file is seeked back to the start afterwards
+func checkContentType(file *os.File, filename string, mediaType MediaType) error {
+	buf := make([]byte, 512)
+	_, err := file.Read(buf)
+	if err != nil {
+		return fmt.Errorf("error reading %q: %w", filename, err)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("error reading %q: %w", filename, err)
+	}
+	contentType := http.DetectContentType(buf)
+	switch mediaType {
+	case VIDEO:
+		if !strings.HasPrefix(contentType, "video") && contentType != "application/octet-stream" {
+			fmt.Printf("WARNING: input file %q doesn't appear to be a video. It has content type %q\n", filename, contentType)
+		}
+	case STRICT_VIDEO:
+		if !strings.HasPrefix(contentType, "video/") {
+			return fmt.Errorf("input file %q doesn't appear to be a video. It has content type %q", filename, contentType)
+		}
+	case IMAGE:
+		if !strings.HasPrefix(contentType, "image") && contentType != "application/octet-stream" {
+			fmt.Printf("WARNING: input file %q doesn't appear to be an image. It has content type %q\n", filename, contentType)
+		}
+	}
+	return nil
+}
+
+// DirectoryVideos returns the video files in dir, sorted by name. Files are recognised by their
+// extension, one of extensions (e.g. ".mp4") or, if that's empty, the usual video extensions.
+// Subdirectories aren't searched. Files modified less than minAge ago may still be being written,
+// and files whose content clearly isn't a video are skipped
+func DirectoryVideos(dir string, minAge time.Duration, extensions []string) ([]string, error) {
+	if len(extensions) == 0 {
+		extensions = videoExtensions
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %q: %w", dir, err)
+	}
+	var videos []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if !slices.Contains(extensions, strings.ToLower(filepath.Ext(entry.Name()))) {
+			continue
+		}
+		filename := filepath.Join(dir, entry.Name())
+		if minAge > 0 {
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			if age := time.Since(info.ModTime()); age < minAge {
+				fmt.Printf("Skipping %q, it was modified %s ago and may still be being written\n", filename, age.Round(time.Second))
+				continue
+			}
+		}
+		if contentType, ok := looksLikeVideo(filename); !ok {
+			fmt.Printf("Skipping %q, it doesn't look like a video. It has content type %q\n", filename, contentType)
+			continue
+		}
+		videos = append(videos, filename)
+	}
+	return videos, nil
+}
+
+// looksLikeVideo sniffs the content type of the file. Many video formats aren't recognised by
+// sniffing, so only empty files and files that are clearly something else are rejected.
+// A file that can't be read is accepted, for the upload to report the error
+func looksLikeVideo(filename string) (string, bool) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", true
+	}
+	defer file.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			return "empty", false
+		}
+		return "", true
+	}
+	contentType := http.DetectContentType(buf[:n])
+	return contentType, strings.HasPrefix(contentType, "video/") || contentType == "application/octet-stream"
+}
+
+// Manifest describes a batch of videos to upload, in order
+type Manifest struct {
+	Videos []ManifestEntry `json:"videos"`
+}
+
+// ManifestEntry is a video in a Manifest. Alongside the filename and thumbnail, an entry has
+// the same fields as a metaJSON file (title, captions, playlistTitles etc.)
+type ManifestEntry struct {
+	Filename  string
+	Thumbnail string
+	VideoMeta
+
+	// Meta is the entry as given, to be used as Config.Meta
+	Meta json.RawMessage
+}
+
+func (e *ManifestEntry) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		Filename  string `json:"filename"`
+		Thumbnail string `json:"thumbnail"`
+	}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &e.VideoMeta)
+	if err != nil {
+		return err
+	}
+	e.Filename = fields.Filename
+	e.Thumbnail = fields.Thumbnail
+	e.Meta = slices.Clone(data)
+	return nil
+}
+
+// LoadManifest reads a Manifest from a JSON file. Every entry must have a filename
+func LoadManifest(filename string) (*Manifest, error) {
+	file, err := readFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %q: %w", filename, err)
+	}
+
+	manifest := &Manifest{}
+	err = json.Unmarshal(file, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest %q: %w", filename, err)
+	}
+	if len(manifest.Videos) == 0 {
+		return nil, fmt.Errorf("manifest %q has no videos", filename)
+	}
+	for i, entry := range manifest.Videos {
+		if entry.Filename == "" {
+			return nil, fmt.Errorf("manifest %q: video %d has no filename", filename, i+1)
+		}
+	}
+
+	return manifest, nil
+}
+
+// SidecarThumbnail returns the image alongside the video with the same name, e.g. "video.jpg"
+// for "video.mp4", or an empty string if there isn't one
+func SidecarThumbnail(filename string) string {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	for _, ext := range thumbnailExtensions {
+		for _, candidate := range []string{base + ext, base + strings.ToUpper(ext)} {
+			if isRegularFile(candidate) {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+// stdinContentType returns the content type of a StdinFormat
+func stdinContentType(format string) (string, error) {
+	if strings.Contains(format, "/") {
+		mediaType, _, err := mime.ParseMediaType(format)
+		if err != nil || (!strings.HasPrefix(mediaType, "video/") && mediaType != "application/octet-stream") {
+			return "", fmt.Errorf("stdinFormat %q isn't a video content type", format)
+		}
+		return mediaType, nil
+	}
+	contentType, ok := videoContentTypes["."+strings.ToLower(strings.TrimPrefix(format, "."))]
+	if !ok {
+		return "", fmt.Errorf("unknown stdinFormat %q, must be a video content type or one of %s", format,
+			strings.ReplaceAll(strings.Join(videoExtensions, ", "), ".", ""))
+	}
+	return contentType, nil
+}
+
+// isRegularFile reports whether filename is a regular file on disk, as opposed to stdin,
+// a URL, or a pipe or device that can only be read once
+func isRegularFile(filename string) bool {
+	if filename == "-" || strings.HasPrefix(filename, "http") {
+		return false
+	}
+	info, err := os.Stat(filename)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// MoveFile moves filename into dir, creating dir if needed, and returns its new name. If a file with
+// the same name is already there, a numeric suffix is added e.g. "video.1.mp4". Moves to another
+// filesystem are done by copying the file then removing the original. Only local files can be moved;
+// for URLs and stdin nothing is done, and the returned name is empty
+func MoveFile(filename, dir string) (string, error) {
+	if !isRegularFile(filename) {
+		return "", nil
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, filepath.Base(filename))
+	if _, err := os.Stat(dest); err == nil {
+		dest, err = nextFreeName(dest)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = os.Rename(filename, dest)
+	if err == nil {
+		return dest, nil
+	}
+
+	// renaming fails across filesystems
+	copyErr := copyFile(filename, dest)
+	if copyErr != nil {
+		return "", errors.Join(err, copyErr)
+	}
+	err = os.Remove(filename)
+	if err != nil {
+		return dest, err
+	}
+	return dest, nil
+}
+
+// copyFile copies src to a new file dest, keeping its permissions. If the copy fails, dest is removed
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return nil
+}
+
+// LoadPreset reads the named preset from a presets file. The file is a JSON object mapping preset names
+// to metadata in the same format as metaJSON. If filename is empty, presets.json is read from the
+// OS specific config dir
+func LoadPreset(filename, name string) (*VideoMeta, error) {
+	if filename == "" {
+		confDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		filename = filepath.Join(confDir, "youtubeuploader", "presets.json")
+	}
+
+	data, err := readFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading presets file %q: %w", filename, err)
+	}
+
+	presets := make(map[string]*VideoMeta)
+	err = json.Unmarshal(data, &presets)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing presets file %q: %w", filename, err)
+	}
+
+	preset, ok := presets[name]
+	if !ok || preset == nil {
+		return nil, fmt.Errorf("preset %q not found in presets file %q", name, filename)
+	}
+
+	return preset, nil
+}
+
+// resolveOutputPath applies the conflict policy when filename already exists.
+// It returns the path to write to, or an empty string if writing should be skipped.
+func resolveOutputPath(filename, policy string) (string, error) {
+	if err := checkConflictPolicy(policy); err != nil {
+		return "", err
+	}
+
+	_, err := os.Stat(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return filename, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	switch policy {
+	case conflictSkip:
+		fmt.Printf("File %q already exists, skipping\n", filename)
+		return "", nil
+	case conflictFail:
+		return "", fmt.Errorf("file %q already exists", filename)
+	case conflictAppendSuffix:
+		return nextFreeName(filename)
+	}
+
+	return filename, nil
+}
+
+// checkChunksize checks that size is a multiple of 256KB, as resumable uploads require. Other sizes
+// are rounded down to a multiple of 256KB (and at least 256KB) with a warning, or are an error if strict
+// is set. Zero, which uploads the video in a single request, is left as it is
+func checkChunksize(size int, strict bool) (int, error) {
+	if size < 0 {
+		return 0, fmt.Errorf("chunksize can't be negative")
+	}
+	if size%googleapi.MinUploadChunkSize == 0 {
+		return size, nil
+	}
+	if strict {
+		return 0, fmt.Errorf("chunksize %d isn't a multiple of 256KB (%d bytes)", size, googleapi.MinUploadChunkSize)
+	}
+	adjusted := max(size-size%googleapi.MinUploadChunkSize, googleapi.MinUploadChunkSize)
+	fmt.Printf("WARNING: chunksize %d isn't a multiple of 256KB. Using %d bytes\n", size, adjusted)
+	return adjusted, nil
+}
+
+func checkConflictPolicy(policy string) error {
+	switch policy {
+	case "", conflictOverwrite, conflictSkip, conflictFail, conflictAppendSuffix:
+		return nil
+	}
+	return fmt.Errorf("invalid conflict policy %q", policy)
+}
+
+// nextFreeName finds an unused filename by inserting an increasing number before the extension e.g. name.1.json
+func nextFreeName(filename string) (string, error) {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.%d%s", base, i, ext)
+		_, err := os.Stat(candidate)
+		if errors.Is(err, fs.ErrNotExist) {
+			return candidate, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// thumbnailLocation reads the GPS coordinates from a local JPEG thumbnail
+func thumbnailLocation(filename string) (*youtube.GeoPoint, error) {
+	if filename == "" || strings.HasPrefix(filename, "http") {
+		return nil, errors.New("thumbnail must be a local file")
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return exifGPS(bufio.NewReader(file))
+}
+
+// exifGPS extracts GPS coordinates from the EXIF data of a JPEG image
+func exifGPS(r io.Reader) (*youtube.GeoPoint, error) {
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xff, 0xd8} {
+		return nil, errors.New("not a JPEG image")
+	}
+
+	// walk the JPEG segments looking for the APP1 Exif segment
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, errNoGPS
+		}
+		if hdr[0] != 0xff {
+			return nil, errors.New("invalid JPEG segment")
+		}
+		// start of scan: image data follows, no more metadata
+		if hdr[1] == 0xda {
+			return nil, errNoGPS
+		}
+		length := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if length < 0 {
+			return nil, errors.New("invalid JPEG segment")
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, errNoGPS
+		}
+		if hdr[1] == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffGPS(segment[6:])
+		}
+	}
+}
+
+// tiffGPS finds the GPS IFD within EXIF TIFF data and decodes the coordinates
+func tiffGPS(data []byte) (*youtube.GeoPoint, error) {
+	if len(data) < 8 {
+		return nil, errNoGPS
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid EXIF byte order")
+	}
+
+	type entry struct {
+		typ    uint16
+		count  uint32
+		offset uint32
+		raw    []byte
+	}
+	readIFD := func(offset uint32) map[uint16]entry {
+		entries := make(map[uint16]entry)
+		if int(offset)+2 > len(data) {
+			return entries
+		}
+		n := int(order.Uint16(data[offset:]))
+		for i := 0; i < n; i++ {
+			pos := int(offset) + 2 + i*12
+			if pos+12 > len(data) {
+				break
+			}
+			e := data[pos : pos+12]
+			entries[order.Uint16(e)] = entry{
+				typ:    order.Uint16(e[2:]),
+				count:  order.Uint32(e[4:]),
+				offset: order.Uint32(e[8:]),
+				raw:    e[8:12],
+			}
+		}
+		return entries
+	}
+	rationals := func(e entry) []float64 {
+		// type 5 is unsigned rational
+		if e.typ != 5 || int(e.offset)+int(e.count)*8 > len(data) {
+			return nil
+		}
+		vals := make([]float64, e.count)
+		for i := range vals {
+			pos := int(e.offset) + i*8
+			num, den := order.Uint32(data[pos:]), order.Uint32(data[pos+4:])
+			if den == 0 {
+				return nil
+			}
+			vals[i] = float64(num) / float64(den)
+		}
+		return vals
+	}
+	coordinate := func(value entry, ref entry, negative byte) (float64, bool) {
+		dms := rationals(value)
+		if len(dms) != 3 {
+			return 0, false
+		}
+		c := dms[0] + dms[1]/60 + dms[2]/3600
+		if ref.raw[0] == negative {
+			c = -c
+		}
+		return c, true
+	}
+
+	ifd0 := readIFD(order.Uint32(data[4:]))
+	gpsPtr, ok := ifd0[0x8825]
+	if !ok {
+		return nil, errNoGPS
+	}
+	gps := readIFD(gpsPtr.offset)
+
+	latRef, ok1 := gps[0x1]
+	lat, ok2 := gps[0x2]
+	lonRef, ok3 := gps[0x3]
+	lon, ok4 := gps[0x4]
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, errNoGPS
+	}
+
+	point := &youtube.GeoPoint{ForceSendFields: []string{"Latitude", "Longitude"}}
+	if point.Latitude, ok = coordinate(lat, latRef, 'S'); !ok {
+		return nil, errors.New("invalid GPS latitude")
+	}
+	if point.Longitude, ok = coordinate(lon, lonRef, 'W'); !ok {
+		return nil, errors.New("invalid GPS longitude")
+	}
+	if alt := rationals(gps[0x6]); len(alt) == 1 {
+		point.Altitude = alt[0]
+		// altitude reference 1 means below sea level
+		if altRef, ok := gps[0x5]; ok && altRef.raw[0] == 1 {
+			point.Altitude = -point.Altitude
+		}
+	}
+
+	return point, nil
+}
+
+// appendSignature adds a footer to the description. Placeholders {version} and {date} in the signature are expanded.
+// The description is truncated if required to keep the total within YouTube's length limit.
+func appendSignature(description, signature, version string) string {
+	footer := strings.NewReplacer(
+		"{version}", version,
+		"{date}", time.Now().Format(inputDateLayout),
+	).Replace(signature)
+
+	sep := "\n\n"
+	if description == "" {
+		sep = ""
+	}
+
+	maxBody := maxDescriptionLength - len(sep) - len(footer)
+	if maxBody <= 0 {
+		return truncateBytes(footer, maxDescriptionLength)
+	}
+
+	return truncateBytes(description, maxBody) + sep + footer
+}
+
+// limitTitle applies the overflow policy to a title longer than YouTube allows, then appends suffix.
+// The title is shortened to make room for the suffix, so that it's never cut off
+func limitTitle(title, suffix, policy string) (string, error) {
+	if err := checkOverflowPolicy(policy); err != nil {
+		return title, fmt.Errorf("invalid title overflow policy: %w", err)
+	}
+	length := utf8.RuneCountInString(title)
+	if length > maxTitleLength && policy != overflowTruncate {
+		return title, fmt.Errorf("title is %d characters long, the maximum allowed is %d", length, maxTitleLength)
+	}
+	maxLength := maxTitleLength - utf8.RuneCountInString(suffix)
+	if length <= maxLength {
+		return title + suffix, nil
+	}
+
+	if suffix == "" {
+		fmt.Printf("Title is %d characters long, truncating to %d\n", length, maxLength)
+	} else {
+		fmt.Printf("Title is %d characters long, truncating to %d to fit %q\n", length, maxLength, suffix)
+	}
+	runes := []rune(title)
+	return string(runes[:maxLength-utf8.RuneCountInString(ellipsis)]) + ellipsis + suffix, nil
+}
+
+// limitDescription applies the overflow policy to a description longer than YouTube allows
+func limitDescription(description, policy string) (string, error) {
+	if err := checkOverflowPolicy(policy); err != nil {
+		return description, fmt.Errorf("invalid description overflow policy: %w", err)
+	}
+	if len(description) <= maxDescriptionLength {
+		return description, nil
+	}
+	if policy != overflowTruncate {
+		return description, fmt.Errorf("description is %d bytes long, the maximum allowed is %d", len(description), maxDescriptionLength)
+	}
+
+	fmt.Printf("Description is %d bytes long, truncating to %d\n", len(description), maxDescriptionLength)
+	return truncateBytes(description, maxDescriptionLength-len(ellipsis)) + ellipsis, nil
+}
+
+func checkOverflowPolicy(policy string) error {
+	switch policy {
+	case "", overflowError, overflowTruncate:
+		return nil
+	}
+	return fmt.Errorf("%q should be one of %q or %q", policy, overflowError, overflowTruncate)
+}
+
+// truncateBytes shortens s to at most n bytes without splitting a UTF-8 sequence
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// isYouTubePageURL reports whether rawURL points to a YouTube watch/short page rather than to media
+func isYouTubePageURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	switch strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.") {
+	case "youtu.be":
+		return u.Path != "" && u.Path != "/"
+	case "youtube.com", "m.youtube.com", "music.youtube.com":
+		if u.Path == "/watch" {
+			return true
+		}
+		for _, prefix := range []string{"/shorts/", "/live/", "/embed/"} {
+			if strings.HasPrefix(u.Path, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// gunzip transparently decompresses reader if filename has a .gz extension or the data starts with the gzip magic bytes.
+// It reports whether the data was compressed.
+func gunzip(filename string, reader io.ReadCloser) (io.ReadCloser, bool, error) {
+	br := bufio.NewReader(reader)
+	magic, _ := br.Peek(len(gzipMagic))
+	if !bytes.Equal(magic, gzipMagic) && !strings.EqualFold(filepath.Ext(filename), ".gz") {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, reader}, false, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		reader.Close()
+		return nil, true, fmt.Errorf("error decompressing %q: %w", filename, err)
+	}
+
+	return &gzipReadCloser{Reader: gz, source: reader, filename: filename}, true, nil
+}
+
+// readFile reads the named file, decompressing it if it is gzipped
+func readFile(filename string) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	reader, _, err := gunzip(filename, file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+func (g *gzipReadCloser) Read(p []byte) (int, error) {
+	n, err := g.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("error decompressing %q: %w", g.filename, err)
+	}
+	return n, err
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.source.Close()
+}
+
+func (d *Date) UnmarshalJSON(b []byte) (err error) {
+	s := string(b)
+	if s == "null" || s == `""` {
+		d.Time = time.Time{}
+		return
+	}
+	s = s[1 : len(s)-1]
+	err = d.parse(s)
+	return
+}
+
+// MarshalJSON writes the date in a format that UnmarshalJSON accepts. A zero date is written as an empty string
+func (d Date) MarshalJSON() ([]byte, error) {
+	if d.IsZero() {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(d.Format(inputDatetimeLayout))
+}
+
+func (d *Date) Set(s string) (err error) {
+	err = d.parse(s)
+	return
+}
+
+func (d *Date) parse(s string) (err error) {
+	// relative to now e.g. '+2h', '+3d'
+	if strings.HasPrefix(s, "+") {
+		var offset time.Duration
+		offset, err = parseRelative(s[1:])
+		if err != nil {
+			return fmt.Errorf("invalid relative time %q: %w", s, err)
+		}
+		d.Time = time.Now().Add(offset)
+		return
+	}
+	// support ISO 8601 date only, and date + time
+	if strings.ContainsAny(s, ":") {
+		d.Time, err = time.Parse(inputDatetimeLayout, s)
+	} else {
+		d.Time, err = time.Parse(inputDateLayout, s)
+	}
+	return
+}
+
+// parseRelative parses a Go duration, with the addition of a 'd' (days) unit e.g. '3d'
+func parseRelative(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
 }
@@ -15,15 +15,64 @@ limitations under the License.
 package youtubeuploader
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	"github.com/pkg/browser"
+	"github.com/porjo/youtubeuploader/internal/utils"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/youtube/v3"
 )
 
+const (
+	// processingPollInterval is how often video processing status is checked
+	processingPollInterval = 15 * time.Second
+
+	// caption inserts that fail with a transient error are retried
+	captionAttempts   = 3
+	captionRetryDelay = time.Second
+
+	// watermark image limits, as enforced by YouTube
+	maxWatermarkSize      = 1 << 20
+	minWatermarkDimension = 150
+)
+
 type Playlistx struct {
 	Id            string
 	Title         string
 	PrivacyStatus string
+
+	// DefaultLanguage is the language of the title and description of a new playlist
+	DefaultLanguage string
+
+	// Thumbnail is an image set as the thumbnail of a new playlist. Client fetches it if it's
+	// a URL, or http.DefaultClient if Client is nil
+	Thumbnail string
+	Client    *http.Client
+
+	// MadeForKids should match the audience of the video being added.
+	// The playlists API has no audience setting, so this is only used to warn
+	// when a new playlist is created for made for kids content.
+	MadeForKids bool
 }
 
 type VideoMeta struct {
@@ -47,11 +96,54 @@ type VideoMeta struct {
 	PlaylistIDs    []string `json:"playlistIds,omitempty"`
 	PlaylistTitles []string `json:"playlistTitles,omitempty"`
 
+	Captions []Caption `json:"captions,omitempty"`
+
+	Chapters []Chapter `json:"chapters,omitempty"`
+
 	// BCP-47 language code e.g. 'en','es'
 	Language string `json:"language,omitempty"`
+
+	// Localizations are translations of the title and description, keyed by BCP-47 language code
+	Localizations map[string]Localization `json:"localizations,omitempty"`
+}
+
+// clone returns a copy of vm that doesn't share any slices with the original
+func (vm *VideoMeta) clone() *VideoMeta {
+	c := *vm
+	c.Tags = slices.Clone(vm.Tags)
+	c.PlaylistIDs = slices.Clone(vm.PlaylistIDs)
+	c.PlaylistTitles = slices.Clone(vm.PlaylistTitles)
+	c.Captions = slices.Clone(vm.Captions)
+	c.Chapters = slices.Clone(vm.Chapters)
+	c.Localizations = maps.Clone(vm.Localizations)
+	return &c
+}
+
+// Chapter is a chapter marker added to the video description
+type Chapter struct {
+	// timestamp e.g. '0:00', '12:30' or '1:02:03'
+	Start string `json:"start"`
+	Title string `json:"title"`
+}
+
+// Localization is the title and description shown to viewers using another language
+type Localization struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// Caption is a caption track to be uploaded with the video
+type Caption struct {
+	Filename string `json:"filename"`
+	// BCP-47 language code. Defaults to the video language
+	Language string `json:"language,omitempty"`
+	// Languages uploads the same file as a track for each of these languages, as well as Language
+	Languages []string `json:"languages,omitempty"`
+	// track name shown to viewers. Defaults to the language
+	Name string `json:"name,omitempty"`
 }
 
-func playlistList(service *youtube.Service, pageToken string) (*youtube.PlaylistListResponse, error) {
+func playlistList(ctx context.Context, service *youtube.Service, pageToken string) (*youtube.PlaylistListResponse, error) {
 	call := service.Playlists.List([]string{"snippet", "contentDetails"})
 	call = call.Mine(true)
 
@@ -59,7 +151,7 @@ func playlistList(service *youtube.Service, pageToken string) (*youtube.Playlist
 		call = call.PageToken(pageToken)
 	}
 
-	response, err := call.Do()
+	response, err := call.Context(ctx).Do()
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving playlists: %w", err)
 	}
@@ -67,14 +159,80 @@ func playlistList(service *youtube.Service, pageToken string) (*youtube.Playlist
 	return response, nil
 }
 
+// choosePlaylist presents a numbered menu of the user's playlists and reads the selection from in.
+// It returns either the ID of an existing playlist or the title of a new playlist to create.
+// Both are empty if no playlist was selected.
+func choosePlaylist(ctx context.Context, service *youtube.Service, in io.Reader) (id string, title string, err error) {
+	var playlists []*youtube.Playlist
+
+	nextPageToken := ""
+	for {
+		playlistResponse, err := playlistList(ctx, service, nextPageToken)
+		if err != nil {
+			return "", "", err
+		}
+		playlists = append(playlists, playlistResponse.Items...)
+
+		nextPageToken = playlistResponse.NextPageToken
+		if nextPageToken == "" {
+			break
+		}
+	}
+
+	fmt.Printf("\nSelect a playlist to add the video to:\n")
+	fmt.Printf("  %3d) none\n", 0)
+	for i, pl := range playlists {
+		fmt.Printf("  %3d) %s (%s)\n", i+1, pl.Snippet.Title, pl.Id)
+	}
+	createIdx := len(playlists) + 1
+	fmt.Printf("  %3d) create a new playlist\n", createIdx)
+
+	reader := bufio.NewReader(in)
+	for {
+		fmt.Printf("Choice [0-%d]: ", createIdx)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", "", fmt.Errorf("error reading playlist choice: %w", err)
+		}
+		choice, err := strconv.Atoi(strings.TrimSpace(line))
+		if err != nil || choice < 0 || choice > createIdx {
+			fmt.Printf("Invalid choice %q\n", strings.TrimSpace(line))
+			continue
+		}
+
+		switch choice {
+		case 0:
+			return "", "", nil
+		case createIdx:
+			for title == "" {
+				fmt.Printf("New playlist title: ")
+				line, err = reader.ReadString('\n')
+				if err != nil {
+					return "", "", fmt.Errorf("error reading playlist title: %w", err)
+				}
+				title = strings.TrimSpace(line)
+			}
+			return "", title, nil
+		default:
+			return playlists[choice-1].Id, "", nil
+		}
+	}
+}
+
+// AddVideoToPlaylist adds the video to the playlist with plx.Id, or titled plx.Title, which is created if it doesn't exist
 func (plx *Playlistx) AddVideoToPlaylist(service *youtube.Service, videoID string) error {
+	return plx.AddVideoToPlaylistContext(context.Background(), service, videoID)
+}
+
+// AddVideoToPlaylistContext is like AddVideoToPlaylist, but stops when ctx is cancelled
+func (plx *Playlistx) AddVideoToPlaylistContext(ctx context.Context, service *youtube.Service, videoID string) error {
 	var playlist *youtube.Playlist
 	var err error
 
 	nextPageToken := ""
 	for {
 		// retrieve the next set of playlists
-		playlistResponse, err := playlistList(service, nextPageToken)
+		playlistResponse, err := playlistList(ctx, service, nextPageToken)
 		if err != nil {
 			return err
 		}
@@ -98,15 +256,27 @@ func (plx *Playlistx) AddVideoToPlaylist(service *youtube.Service, videoID strin
 		if plx.Id != "" {
 			return fmt.Errorf("playlist ID %q doesn't exist", plx.Id)
 		}
+		if plx.MadeForKids {
+			fmt.Printf("WARNING: the YouTube API doesn't support setting the audience of a playlist. "+
+				"Playlist %q will be created without the 'made for kids' setting. Set it in YouTube Studio if required\n", plx.Title)
+		}
 		playlist = &youtube.Playlist{}
-		playlist.Snippet = &youtube.PlaylistSnippet{Title: plx.Title}
+		playlist.Snippet = &youtube.PlaylistSnippet{Title: plx.Title, DefaultLanguage: plx.DefaultLanguage}
 		playlist.Status = &youtube.PlaylistStatus{PrivacyStatus: plx.PrivacyStatus}
 		insertCall := service.Playlists.Insert([]string{"snippet", "status"}, playlist)
 		// API doesn't return playlist ID here!?
-		playlist, err = insertCall.Do()
+		playlist, err = insertCall.Context(ctx).Do()
 		if err != nil {
 			return fmt.Errorf("error creating playlist with title %q: %w", plx.Title, err)
 		}
+		if plx.Thumbnail != "" {
+			// without a thumbnail of its own, a playlist shows the thumbnail of its first video,
+			// which for a new playlist is the video being added
+			err = setPlaylistThumbnail(ctx, service, plx.Client, playlist.Id, plx.Thumbnail)
+			if err != nil {
+				fmt.Printf("WARNING: playlist %q will use the video's thumbnail: %s\n", plx.Title, err)
+			}
+		}
 	}
 
 	playlistItem := &youtube.PlaylistItem{}
@@ -117,7 +287,7 @@ func (plx *Playlistx) AddVideoToPlaylist(service *youtube.Service, videoID strin
 	}
 
 	insertCall := service.PlaylistItems.Insert([]string{"snippet"}, playlistItem)
-	_, err = insertCall.Do()
+	_, err = insertCall.Context(ctx).Do()
 	if err != nil {
 		return err
 	}
@@ -126,3 +296,626 @@ func (plx *Playlistx) AddVideoToPlaylist(service *youtube.Service, videoID strin
 
 	return nil
 }
+
+// setPlaylistThumbnail uploads the image as the playlist's thumbnail. The playlistImages API isn't
+// available to every channel, so this can fail even with a valid image
+func setPlaylistThumbnail(ctx context.Context, service *youtube.Service, client *http.Client, playlistID, filename string) error {
+	reader, _, err := OpenWithClient(filename, IMAGE, client)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	fmt.Printf("Uploading playlist thumbnail %q...\n", filename)
+	playlistImage := &youtube.PlaylistImage{
+		Snippet: &youtube.PlaylistImageSnippet{
+			PlaylistId: playlistID,
+			Type:       "hero",
+		},
+	}
+	_, err = service.PlaylistImages.Insert(playlistImage).Part("snippet").Media(reader).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error uploading playlist thumbnail: %w", err)
+	}
+	return nil
+}
+
+// confirmUpload prints the metadata the video will be uploaded with and asks the user to confirm
+func confirmUpload(in io.Reader, filename string, video *youtube.Video, videoMeta *VideoMeta) (bool, error) {
+	fmt.Printf("\nFile:         %s\n", filename)
+	fmt.Printf("Title:        %s\n", video.Snippet.Title)
+	fmt.Printf("Category:     %s\n", video.Snippet.CategoryId)
+	fmt.Printf("Tags:         %s\n", strings.Join(video.Snippet.Tags, ", "))
+	fmt.Printf("Language:     %s\n", video.Snippet.DefaultLanguage)
+	fmt.Printf("Privacy:      %s\n", video.Status.PrivacyStatus)
+	if video.Status.PublishAt != "" {
+		fmt.Printf("Publish at:   %s\n", video.Status.PublishAt)
+	}
+	if video.RecordingDetails.RecordingDate != "" {
+		fmt.Printf("Recorded:     %s\n", video.RecordingDetails.RecordingDate)
+	}
+	if len(videoMeta.PlaylistIDs) > 0 || len(videoMeta.PlaylistTitles) > 0 {
+		fmt.Printf("Playlists:    %s\n", strings.Join(slices.Concat(videoMeta.PlaylistIDs, videoMeta.PlaylistTitles), ", "))
+	}
+	for _, c := range videoMeta.Captions {
+		fmt.Printf("Caption:      %s (%s)\n", c.Filename, c.Language)
+	}
+	fmt.Printf("Description:\n%s\n\n", video.Snippet.Description)
+
+	fmt.Printf("Upload? [y/N]: ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("error reading confirmation: %w", err)
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes", nil
+}
+
+// openVideo opens the video's watch or studio page in the browser. Nothing is
+// done when there's no user to see it, such as in scripts or over SSH
+func openVideo(videoID, page string) {
+	if !utils.IsTerminal(os.Stdin) {
+		return
+	}
+	switch runtime.GOOS {
+	case "windows", "darwin":
+	default:
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return
+		}
+	}
+
+	url := "https://www.youtube.com/watch?v=" + videoID
+	if page == "studio" {
+		url = "https://studio.youtube.com/video/" + videoID + "/edit"
+	}
+	err := browser.OpenURL(url)
+	if err != nil {
+		fmt.Printf("WARNING: error opening %s: %s\n", url, err)
+	}
+}
+
+// forbiddenHints explain what to do about the reasons YouTube gives for refusing an upload
+var forbiddenHints = map[string]string{
+	"youtubeSignupRequired": "The account doesn't have a YouTube channel. Create one at https://www.youtube.com/create_channel, then try again",
+	"forbidden":             "The account isn't allowed to upload. Check that it has a YouTube channel linked to it, and that uploading isn't disabled at https://www.youtube.com/verify",
+	"uploadLimitExceeded":   "The channel has reached YouTube's limit on the number of videos uploaded. Try again in 24 hours",
+}
+
+// forbiddenHint returns the guidance for err if it's a 403 error with one of the forbiddenHints reasons
+func forbiddenHint(err error) string {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return ""
+	}
+	for _, item := range apiErr.Errors {
+		if hint, ok := forbiddenHints[item.Reason]; ok {
+			return hint
+		}
+	}
+	return ""
+}
+
+// invalidMetadataFields are the fields named by the reasons YouTube gives for rejecting a video's metadata
+var invalidMetadataFields = map[string]string{
+	"invalidTitle":       "title",
+	"invalidDescription": "description",
+}
+
+// invalidMetadataHint returns which field of the snippet YouTube rejected and why, if err is a 400 error
+// about the video's metadata. Reasons without a field of their own are pinpointed by the error's location
+func invalidMetadataHint(err error, snippet *youtube.VideoSnippet) string {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+		return ""
+	}
+
+	// googleapi.ErrorItem doesn't keep the location, so the errors are read from the response body
+	var body struct {
+		Error struct {
+			Errors []struct {
+				Reason   string `json:"reason"`
+				Message  string `json:"message"`
+				Location string `json:"location"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(apiErr.Body), &body) != nil {
+		return ""
+	}
+	for _, item := range body.Error.Errors {
+		switch invalidMetadataFields[item.Reason] {
+		case "title":
+			return fmt.Sprintf("YouTube rejected the title %q (%d characters): %s. Titles must be 1 to %d characters long and can't contain < or >",
+				snippet.Title, utf8.RuneCountInString(snippet.Title), item.Message, maxTitleLength)
+		case "description":
+			return fmt.Sprintf("YouTube rejected the description (%d bytes): %s. Descriptions can be at most %d bytes long and can't contain < or >",
+				len(snippet.Description), item.Message, maxDescriptionLength)
+		}
+		// e.g. "body.snippet.tags"
+		if field, ok := strings.CutPrefix(item.Location, "body."); ok {
+			return fmt.Sprintf("YouTube rejected the %s field: %s", field, item.Message)
+		}
+	}
+	return ""
+}
+
+// setVideoPrivacy changes the privacy status of an uploaded video.
+// Any scheduled publish time is cleared so the new status takes effect immediately.
+func setVideoPrivacy(ctx context.Context, service *youtube.Service, video *youtube.Video, privacy string) error {
+	status := &youtube.VideoStatus{}
+	if video.Status != nil {
+		*status = *video.Status
+	}
+	status.PrivacyStatus = privacy
+	status.PublishAt = ""
+	status.ForceSendFields = []string{"SelfDeclaredMadeForKids"}
+
+	update := &youtube.Video{
+		Id:     video.Id,
+		Status: status,
+	}
+	_, err := service.Videos.Update([]string{"status"}, update).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error updating video %s: %w", video.Id, err)
+	}
+
+	return nil
+}
+
+// waitForProcessing polls the video until YouTube has finished processing it, or timeout is reached.
+// A zero timeout waits indefinitely.
+func waitForProcessing(ctx context.Context, service *youtube.Service, videoID string, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(processingPollInterval)
+	defer ticker.Stop()
+
+	fmt.Printf("Waiting for video %s to finish processing...\n", videoID)
+	for {
+		resp, err := service.Videos.List([]string{"processingDetails"}).Id(videoID).Context(ctx).Do()
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("timed out after %s waiting for video processing", timeout)
+			}
+			return fmt.Errorf("error retrieving video processing status: %w", err)
+		}
+		if len(resp.Items) == 0 {
+			return fmt.Errorf("video %s not found", videoID)
+		}
+
+		details := resp.Items[0].ProcessingDetails
+		if details != nil {
+			switch details.ProcessingStatus {
+			case "succeeded":
+				return nil
+			case "failed", "terminated":
+				return fmt.Errorf("video processing %s: %s", details.ProcessingStatus, details.ProcessingFailureReason)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out after %s waiting for video processing", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// setAutoThumbnail makes one of the three thumbnails generated by YouTube (numbered 1-3) the default.
+// The API has no call to select a generated thumbnail, so the chosen image, which is only 480x360,
+// is fetched with client and uploaded as a custom thumbnail.
+func setAutoThumbnail(ctx context.Context, service *youtube.Service, client *http.Client, videoID string, n int) error {
+	url := fmt.Sprintf("https://i.ytimg.com/vi/%s/hq%d.jpg", videoID, n)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching generated thumbnail %d: %w", n, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error fetching generated thumbnail %d: %s", n, resp.Status)
+	}
+
+	_, err = service.Thumbnails.Set(videoID).Media(resp.Body).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error setting thumbnail: %w", err)
+	}
+
+	return nil
+}
+
+// uploadCaptions inserts each caption track, running up to concurrency inserts at a time
+func uploadCaptions(ctx context.Context, service *youtube.Service, client *http.Client, videoID string, captions []Caption, concurrency int, replace bool) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	errs := make([]error, len(captions))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, caption := range captions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			attempt := 0
+			// the reader is consumed by each attempt, so the caption is opened again on retry
+			errs[i] = retry(captionAttempts, captionRetryDelay, func() error {
+				attempt++
+				if attempt > 1 {
+					fmt.Printf("Retrying caption %q (attempt %d of %d)...\n", caption.Filename, attempt, captionAttempts)
+				}
+				return insertCaption(ctx, service, client, videoID, caption, replace)
+			})
+		}()
+	}
+	wg.Wait()
+
+	if len(captions) > 1 {
+		for i, caption := range captions {
+			if errs[i] != nil {
+				fmt.Printf("Caption %q (%s) failed: %s\n", caption.Filename, caption.Language, errs[i])
+			} else {
+				fmt.Printf("Caption %q (%s) uploaded\n", caption.Filename, caption.Language)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// insertCaption adds the caption track to the video. With replace, a track already on the video in
+// the same language is updated instead. It's looked up on every attempt, so that a retry doesn't
+// add a second track when an earlier attempt succeeded without a response
+func insertCaption(ctx context.Context, service *youtube.Service, client *http.Client, videoID string, caption Caption, replace bool) error {
+	var existingID string
+	if replace {
+		var err error
+		existingID, err = findCaption(ctx, service, videoID, caption.Language)
+		if err != nil {
+			return err
+		}
+	}
+
+	captionReader, _, err := OpenWithClient(caption.Filename, CAPTION, client)
+	if err != nil {
+		return err
+	}
+	defer captionReader.Close()
+
+	if existingID != "" {
+		fmt.Printf("Replacing %s caption with %q...\n", caption.Language, caption.Filename)
+		captionObj := &youtube.Caption{
+			Id:      existingID,
+			Snippet: &youtube.CaptionSnippet{},
+		}
+		captionRes, err := service.Captions.Update([]string{"snippet"}, captionObj).Sync(true).Media(captionReader).Context(ctx).Do()
+		if err != nil {
+			if captionRes != nil {
+				return fmt.Errorf("error updating caption: %w, %v", err, captionRes.HTTPStatusCode)
+			}
+			return fmt.Errorf("error updating caption: %w", err)
+		}
+		return nil
+	}
+
+	fmt.Printf("Uploading caption %q...\n", caption.Filename)
+	captionObj := &youtube.Caption{
+		Snippet: &youtube.CaptionSnippet{},
+	}
+	captionObj.Snippet.VideoId = videoID
+	captionObj.Snippet.Language = caption.Language
+	captionObj.Snippet.Name = caption.Name
+	captionInsert := service.Captions.Insert([]string{"snippet"}, captionObj).Sync(true)
+	captionRes, err := captionInsert.Media(captionReader).Context(ctx).Do()
+	if err != nil {
+		if captionRes != nil {
+			return fmt.Errorf("error inserting caption: %w, %v", err, captionRes.HTTPStatusCode)
+		} else {
+			return fmt.Errorf("error inserting caption: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// findCaption returns the ID of the video's caption track in language, or "" if there isn't one.
+// Tracks generated by YouTube's speech recognition are ignored, as they can't be updated
+func findCaption(ctx context.Context, service *youtube.Service, videoID, language string) (string, error) {
+	response, err := service.Captions.List([]string{"snippet"}, videoID).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("error listing captions: %w", err)
+	}
+	for _, caption := range response.Items {
+		if caption.Snippet == nil || strings.EqualFold(caption.Snippet.TrackKind, "asr") {
+			continue
+		}
+		if strings.EqualFold(caption.Snippet.Language, language) {
+			return caption.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// readWatermark reads a watermark image, checking it meets YouTube's format and size requirements.
+// The image data and content type are returned
+func readWatermark(filename string, client *http.Client) ([]byte, string, error) {
+	reader, _, err := OpenWithClient(filename, IMAGE, client)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxWatermarkSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading watermark %q: %w", filename, err)
+	}
+	if len(data) > maxWatermarkSize {
+		return nil, "", fmt.Errorf("watermark %q is larger than 1MB", filename)
+	}
+
+	contentType := http.DetectContentType(data)
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", fmt.Errorf("error decoding watermark %q: %w", filename, err)
+		}
+		if cfg.Width < minWatermarkDimension || cfg.Height < minWatermarkDimension {
+			return nil, "", fmt.Errorf("watermark %q is %dx%d, must be at least %dx%d pixels",
+				filename, cfg.Width, cfg.Height, minWatermarkDimension, minWatermarkDimension)
+		}
+	case "image/bmp":
+		// dimensions aren't checked for BMP
+	default:
+		return nil, "", fmt.Errorf("watermark %q must be a PNG, JPEG, GIF or BMP image, not %s", filename, contentType)
+	}
+
+	return data, contentType, nil
+}
+
+// setWatermark sets the branding watermark shown on all videos of the authorized channel
+func setWatermark(service *youtube.Service, data []byte, contentType string) error {
+	channels, err := service.Channels.List([]string{"id"}).Mine(true).Do()
+	if err != nil {
+		return fmt.Errorf("error getting channel: %w", err)
+	}
+	if len(channels.Items) == 0 {
+		return fmt.Errorf("no channel found for the authorized account")
+	}
+	channelID := channels.Items[0].Id
+
+	branding := &youtube.InvideoBranding{
+		Position: &youtube.InvideoPosition{
+			Type:           "corner",
+			CornerPosition: "bottomRight",
+		},
+		// show for the whole video
+		Timing: &youtube.InvideoTiming{
+			Type:            "offsetFromStart",
+			ForceSendFields: []string{"OffsetMs"},
+		},
+	}
+
+	err = service.Watermarks.Set(channelID, branding).Media(bytes.NewReader(data), googleapi.ContentType(contentType)).Do()
+	if err != nil {
+		return fmt.Errorf("error setting watermark: %w", err)
+	}
+
+	fmt.Printf("Watermark set for channel %s\n", channelID)
+	return nil
+}
+
+// listChannels returns the channels that can be uploaded to. For content owners,
+// these are the channels managed by the owner, otherwise it's the authorized channel
+func listChannels(ctx context.Context, service *youtube.Service, contentOwner string) ([]*youtube.Channel, error) {
+	call := service.Channels.List([]string{"id", "snippet"}).MaxResults(50)
+	if contentOwner != "" {
+		call = call.ManagedByMe(true).OnBehalfOfContentOwner(contentOwner)
+	} else {
+		call = call.Mine(true)
+	}
+
+	var channels []*youtube.Channel
+	err := call.Pages(ctx, func(resp *youtube.ChannelListResponse) error {
+		channels = append(channels, resp.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing channels: %w", err)
+	}
+	return channels, nil
+}
+
+// checkTargetChannel returns an error if the authorized channel isn't channelID
+func checkTargetChannel(ctx context.Context, service *youtube.Service, channelID string) error {
+	channels, err := listChannels(ctx, service, "")
+	if err != nil {
+		return err
+	}
+	for _, c := range channels {
+		if c.Id == channelID {
+			return nil
+		}
+	}
+
+	var ids []string
+	for _, c := range channels {
+		ids = append(ids, fmt.Sprintf("%s (%s)", c.Id, c.Snippet.Title))
+	}
+	return fmt.Errorf("authorized channel is %s, not target channel %s. Delete the token cache and authorize with the target channel",
+		strings.Join(ids, ", "), channelID)
+}
+
+// inferredCategory caches the result of inferCategory for each channel, by the token cache
+// file used to upload to it
+var inferredCategory struct {
+	sync.Mutex
+	ids map[string]string
+}
+
+// inferCategory returns the category used most often by the recent uploads of the channel
+// authorized by cacheFile
+func inferCategory(ctx context.Context, service *youtube.Service, cacheFile string) (string, error) {
+	inferredCategory.Lock()
+	defer inferredCategory.Unlock()
+	if id, ok := inferredCategory.ids[cacheFile]; ok {
+		return id, nil
+	}
+
+	search, err := service.Search.List([]string{"id"}).ForMine(true).Type("video").Order("date").MaxResults(50).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("error searching uploads: %w", err)
+	}
+	var ids []string
+	for _, item := range search.Items {
+		if item.Id != nil && item.Id.VideoId != "" {
+			ids = append(ids, item.Id.VideoId)
+		}
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("no previous uploads found")
+	}
+
+	videos, err := service.Videos.List([]string{"snippet"}).Id(ids...).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("error listing uploads: %w", err)
+	}
+	counts := make(map[string]int)
+	for _, v := range videos.Items {
+		if v.Snippet != nil && v.Snippet.CategoryId != "" {
+			counts[v.Snippet.CategoryId]++
+		}
+	}
+
+	var best string
+	for id, n := range counts {
+		// lowest ID wins a tie, so the result doesn't depend on map order
+		if n > counts[best] || (n == counts[best] && id < best) {
+			best = id
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no categories found on previous uploads")
+	}
+
+	if inferredCategory.ids == nil {
+		inferredCategory.ids = make(map[string]string)
+	}
+	inferredCategory.ids[cacheFile] = best
+	return best, nil
+}
+
+// getVideo fetches the current metadata of an existing video
+func getVideo(service *youtube.Service, videoID string) (*youtube.Video, error) {
+	resp, err := service.Videos.List([]string{"snippet", "status", "statistics", "recordingDetails"}).Id(videoID).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error getting video %s: %w", videoID, err)
+	}
+	if len(resp.Items) == 0 {
+		return nil, fmt.Errorf("video %s not found", videoID)
+	}
+	return resp.Items[0], nil
+}
+
+// verifyThumbnail checks that YouTube returned the thumbnail when it was set, and that the video
+// then lists a thumbnail. The API doesn't say whether a video's thumbnail is custom or generated,
+// as both have the same URLs, so this can't confirm that the custom thumbnail is the one shown
+func verifyThumbnail(ctx context.Context, service *youtube.Service, videoID string, setResp *youtube.ThumbnailSetResponse) error {
+	if setResp == nil || len(setResp.Items) == 0 || setResp.Items[0].Default == nil {
+		return errors.New("no thumbnail was returned after setting it")
+	}
+
+	resp, err := service.Videos.List([]string{"snippet"}).Id(videoID).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error getting video %s: %w", videoID, err)
+	}
+	if len(resp.Items) == 0 {
+		return fmt.Errorf("video %s not found", videoID)
+	}
+	thumbnails := resp.Items[0].Snippet.Thumbnails
+	if thumbnails == nil || thumbnails.Default == nil {
+		return errors.New("the video has no thumbnails")
+	}
+	return nil
+}
+
+// printVideo writes a human readable summary of the video to w
+func printVideo(w io.Writer, video *youtube.Video) {
+	fmt.Fprintf(w, "ID:           %s\n", video.Id)
+	if sn := video.Snippet; sn != nil {
+		fmt.Fprintf(w, "Title:        %s\n", sn.Title)
+		fmt.Fprintf(w, "Channel:      %s (%s)\n", sn.ChannelTitle, sn.ChannelId)
+		fmt.Fprintf(w, "Published:    %s\n", sn.PublishedAt)
+		fmt.Fprintf(w, "Category:     %s\n", sn.CategoryId)
+		fmt.Fprintf(w, "Tags:         %s\n", strings.Join(sn.Tags, ", "))
+		fmt.Fprintf(w, "Language:     %s\n", sn.DefaultLanguage)
+	}
+	if st := video.Status; st != nil {
+		fmt.Fprintf(w, "Privacy:      %s\n", st.PrivacyStatus)
+		if st.PublishAt != "" {
+			fmt.Fprintf(w, "Publish at:   %s\n", st.PublishAt)
+		}
+		fmt.Fprintf(w, "Upload:       %s\n", st.UploadStatus)
+		fmt.Fprintf(w, "License:      %s\n", st.License)
+		fmt.Fprintf(w, "Embeddable:   %t\n", st.Embeddable)
+		fmt.Fprintf(w, "For kids:     %t\n", st.MadeForKids)
+	}
+	if rd := video.RecordingDetails; rd != nil && rd.RecordingDate != "" {
+		fmt.Fprintf(w, "Recorded:     %s\n", rd.RecordingDate)
+	}
+	if stats := video.Statistics; stats != nil {
+		fmt.Fprintf(w, "Views:        %d\n", stats.ViewCount)
+		fmt.Fprintf(w, "Likes:        %d\n", stats.LikeCount)
+		fmt.Fprintf(w, "Comments:     %d\n", stats.CommentCount)
+	}
+	if sn := video.Snippet; sn != nil && sn.Description != "" {
+		fmt.Fprintf(w, "Description:\n%s\n", sn.Description)
+	}
+}
+
+// videoToMeta converts the video's metadata to the format used by metaJSON.
+// Playlists aren't included, as finding them would mean searching every playlist
+func videoToMeta(video *youtube.Video) *VideoMeta {
+	vm := &VideoMeta{}
+
+	if sn := video.Snippet; sn != nil {
+		vm.Title = sn.Title
+		vm.Description = sn.Description
+		vm.CategoryId = sn.CategoryId
+		vm.Tags = sn.Tags
+		vm.Language = sn.DefaultLanguage
+		if vm.Language == "" {
+			vm.Language = sn.DefaultAudioLanguage
+		}
+	}
+
+	if st := video.Status; st != nil {
+		vm.PrivacyStatus = st.PrivacyStatus
+		vm.Embeddable = st.Embeddable
+		vm.License = st.License
+		vm.PublicStatsViewable = st.PublicStatsViewable
+		// madeForKids may have been set by YouTube rather than the uploader
+		vm.MadeForKids = st.SelfDeclaredMadeForKids || st.MadeForKids
+		if t, err := time.Parse(time.RFC3339, st.PublishAt); err == nil {
+			vm.PublishAt = Date{t}
+		}
+	}
+
+	if rd := video.RecordingDetails; rd != nil {
+		if t, err := time.Parse(time.RFC3339, rd.RecordingDate); err == nil {
+			vm.RecordingDate = Date{t}
+		}
+	}
+
+	return vm
+}
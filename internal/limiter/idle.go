@@ -0,0 +1,87 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdle is returned by an upload request that was abandoned because no data was sent for
+// the idle timeout. It also wraps io.ErrUnexpectedEOF, so that the chunk is retried
+var ErrIdle = errors.New("upload stalled")
+
+// SetIdleTimeout abandons upload requests when no data has been sent for timeout, rather than
+// waiting for the connection to time out. Time spent waiting for the rate limit doesn't count
+// as idle. Chunks of a resumable upload are then retried, otherwise the upload fails. Zero disables this
+func (t *LimitTransport) SetIdleTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("idle timeout can't be negative")
+	}
+	t.reader.Lock()
+	defer t.reader.Unlock()
+	t.idleTimeout = timeout
+	return nil
+}
+
+// states of an idle watch
+const (
+	watching int32 = iota
+	stopped
+	abandoned
+)
+
+// watchIdle returns a copy of r that is cancelled if no data is sent for the idle timeout.
+// Once the request has been written, waiting for the response doesn't count as idle.
+// The returned stop function ends the watch, and reports whether r was cancelled
+func (t *LimitTransport) watchIdle(r *http.Request) (*http.Request, func() bool) {
+	var state atomic.Int32
+	var written atomic.Bool
+	ctx, cancel := context.WithCancelCause(r.Context())
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { written.Store(true) },
+	})
+
+	t.reader.lastActive.Store(time.Now().UnixNano())
+
+	go func() {
+		ticker := time.NewTicker(t.idleTimeout / 4)
+		defer ticker.Stop()
+		for range ticker.C {
+			if state.Load() != watching || written.Load() {
+				return
+			}
+			if t.reader.throttled.Load() {
+				continue
+			}
+			lastActive := time.Unix(0, t.reader.lastActive.Load())
+			if time.Since(lastActive) >= t.idleTimeout && state.CompareAndSwap(watching, abandoned) {
+				cancel(ErrIdle)
+				return
+			}
+		}
+	}()
+
+	// the context isn't cancelled when the watch stops, as the response body is still to be read
+	stop := func() bool {
+		return !state.CompareAndSwap(watching, stopped)
+	}
+	return r.WithContext(ctx), stop
+}
@@ -20,8 +20,10 @@ import (
 	"io"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/porjo/youtubeuploader/internal/utils"
@@ -36,6 +38,27 @@ type LimitTransport struct {
 	filesize   int
 	rateLimit  int
 
+	// result of the most recent upload request, used to describe retries
+	lastResult string
+	lastEnd    time.Time
+	retryLog   io.Writer
+
+	// idleTimeout is how long an upload request can go without sending data before it's abandoned
+	idleTimeout time.Duration
+
+	// uploadWindow is the daily window that upload requests wait for. See SetUploadWindow
+	uploadWindow LimitRange
+
+	// lastStart is when the most recent upload request started. retrySpent is the time spent
+	// retrying chunks so far, which is limited to maxRetryDuration. See SetMaxRetryDuration
+	lastStart        time.Time
+	retrySpent       time.Duration
+	maxRetryDuration time.Duration
+
+	// uploadID identifies the resumable upload session. See SetUploadIDHandler
+	uploadID        string
+	uploadIDHandler func(id string)
+
 	logger utils.Logger
 }
 
@@ -53,17 +76,66 @@ type limitChecker struct {
 	status     Status
 	rateLimit  int
 	burstLimit int
+
+	// bandwidthShare is the percentage of the bandwidth measured during the first
+	// probeDuration of the upload that the rate is then limited to
+	bandwidthShare int
+	probeDuration  time.Duration
+	probed         bool
+
+	// lastActive is when data was last read, in Unix nanoseconds, or when the rate limiter
+	// last finished waiting. throttled is set while the rate limiter is waiting. Both are
+	// read by the idle watchdog without holding the lock
+	lastActive atomic.Int64
+	throttled  atomic.Bool
+
+	// smoothing is the weight given to each new rate sample in Status.SmoothRate.
+	// sampleTime and sampleBytes are the time and byte count of the previous sample
+	smoothing   float64
+	sampleTime  time.Time
+	sampleBytes int
 }
 
+// minRateWindow is how long the upload must have been running before the
+// average rate is considered stable enough to estimate time remaining
+const minRateWindow = 2 * time.Second
+
+// rateSampleInterval is how often the upload rate is sampled for Status.SmoothRate
+const rateSampleInterval = time.Second
+
+// DefaultRateSmoothing is the default weight given to each rate sample when estimating the
+// time remaining. See SetRateSmoothing
+const DefaultRateSmoothing = 0.2
+
 type Status struct {
 	AvgRate    int // Bytes per second
 	Bytes      int
 	TotalBytes int
 
+	// SmoothRate is an exponentially weighted moving average of the rate in bytes per second,
+	// which follows changes in speed faster than AvgRate. It's used to estimate TimeRem
+	SmoothRate int
+
 	Progress string
 
 	Start   time.Time
 	TimeRem time.Duration
+
+	// RateStable is false until enough data has been sent to give a sensible
+	// AvgRate. TimeRem should be ignored until then.
+	RateStable bool
+
+	// Chunk is the number of the chunk currently being sent in a resumable upload, starting at 1.
+	// It is zero for non-resumable uploads. Chunks is the total number of chunks, or zero if unknown.
+	Chunk  int
+	Chunks int
+	// ChunkRetry counts how many times the current chunk has been resent
+	ChunkRetry int
+	// Retries counts the chunks resent over the whole upload
+	Retries int
+
+	chunkSize  int64
+	chunkStart int64
 }
 
 func (lc *limitChecker) Read(p []byte) (int, error) {
@@ -77,6 +149,18 @@ func (lc *limitChecker) Read(p []byte) (int, error) {
 		lc.status.Start = time.Now()
 	}
 
+	if lc.bandwidthShare > 0 && !lc.probed && time.Since(lc.status.Start) >= lc.probeDuration {
+		lc.probed = true
+		// Bytes/s -> Kbps = Bps*8/1000
+		measured := lc.status.AvgRate * 8 / 1000
+		lc.rateLimit = measured * lc.bandwidthShare / 100
+		if lc.rateLimit > 0 {
+			fmt.Printf("\nMeasured upload bandwidth %d Kbps, limiting to %d%% (%d Kbps)\n", measured, lc.bandwidthShare, lc.rateLimit)
+		} else {
+			fmt.Printf("\nUnable to measure upload bandwidth, not limiting upload rate\n")
+		}
+	}
+
 	if lc.rateLimit > 0 {
 		if lc.limiter == nil {
 			lc.burstLimit = len(p)
@@ -108,6 +192,7 @@ func (lc *limitChecker) Read(p []byte) (int, error) {
 	}
 
 	read, err := lc.ReadCloser.Read(p)
+	lc.lastActive.Store(time.Now().UnixNano())
 	if err != nil {
 		return read, err
 	}
@@ -121,7 +206,10 @@ func (lc *limitChecker) Read(p []byte) (int, error) {
 			tokens = lc.burstLimit
 		}
 
+		lc.throttled.Store(true)
 		err = lc.limiter.WaitN(context.Background(), tokens)
+		lc.throttled.Store(false)
+		lc.lastActive.Store(time.Now().UnixNano())
 		if err != nil {
 			return read, err
 		}
@@ -130,21 +218,61 @@ func (lc *limitChecker) Read(p []byte) (int, error) {
 
 	lc.status.Bytes += read
 
+	elapsed := time.Since(lc.status.Start)
+	if elapsed > 0 {
+		lc.status.AvgRate = int(float64(lc.status.Bytes) / elapsed.Seconds())
+	}
+	lc.sampleRate()
+	// the first few reads happen before any meaningful amount of time has passed,
+	// which gives wildly inaccurate (or zero) rates
+	lc.status.RateStable = elapsed >= minRateWindow && lc.status.AvgRate > 0
+
 	if lc.status.TotalBytes > 0 {
 		// bytes read may be greater than filesize due to MIME multipart headers in body. Reset to filesize
 		if lc.status.Bytes > lc.status.TotalBytes {
 			lc.status.Bytes = lc.status.TotalBytes
 		}
 		lc.status.Progress = fmt.Sprintf("%.1f%%", float64(lc.status.Bytes)/float64(lc.status.TotalBytes)*100)
-		lc.status.TimeRem = time.Duration(float64(lc.status.TotalBytes-lc.status.Bytes)/float64(lc.status.AvgRate)) * time.Second
+		if lc.status.RateStable {
+			currentRate := lc.status.AvgRate
+			if lc.status.SmoothRate > 0 {
+				currentRate = lc.status.SmoothRate
+			}
+			lc.status.TimeRem = time.Duration(float64(lc.status.TotalBytes-lc.status.Bytes)/float64(currentRate)) * time.Second
+		} else {
+			lc.status.TimeRem = 0
+		}
 	} else {
 		lc.status.Progress = "n/a"
 	}
-	lc.status.AvgRate = int(float64(lc.status.Bytes) / time.Since(lc.status.Start).Seconds())
 
 	return read, err
 }
 
+// sampleRate updates Status.SmoothRate with the rate since the previous sample, once
+// rateSampleInterval has passed. The first sample is taken from the start of the upload
+func (lc *limitChecker) sampleRate() {
+	if lc.smoothing == 0 {
+		return
+	}
+	if lc.sampleTime.IsZero() {
+		lc.sampleTime = lc.status.Start
+	}
+	now := time.Now()
+	interval := now.Sub(lc.sampleTime)
+	if interval < rateSampleInterval {
+		return
+	}
+	sample := float64(lc.status.Bytes-lc.sampleBytes) / interval.Seconds()
+	if lc.status.SmoothRate == 0 {
+		lc.status.SmoothRate = int(sample)
+	} else {
+		lc.status.SmoothRate = int(lc.smoothing*sample + (1-lc.smoothing)*float64(lc.status.SmoothRate))
+	}
+	lc.sampleTime = now
+	lc.sampleBytes = lc.status.Bytes
+}
+
 func (lc *limitChecker) Close() error {
 	return lc.ReadCloser.Close()
 }
@@ -155,20 +283,20 @@ func ParseLimitBetween(between, inputTimeLayout string) (LimitRange, error) {
 	var start, end time.Time
 	parts := strings.Split(between, "-")
 	if len(parts) != 2 {
-		return lr, fmt.Errorf("limitBetween should have 2 parts separated by a hyphen")
+		return lr, fmt.Errorf("time range should have 2 parts separated by a hyphen")
 	}
 
 	now := time.Now()
 
 	start, err = time.ParseInLocation(inputTimeLayout, parts[0], time.Local)
 	if err != nil {
-		return lr, fmt.Errorf("limitBetween start time was invalid: %v", err)
+		return lr, fmt.Errorf("start time was invalid: %v", err)
 	}
 	lr.start = time.Date(now.Year(), now.Month(), now.Day(), start.Hour(), start.Minute(), 0, 0, time.Local)
 
 	end, err = time.ParseInLocation(inputTimeLayout, parts[1], time.Local)
 	if err != nil {
-		return lr, fmt.Errorf("limitBetween end time was invalid: %v", err)
+		return lr, fmt.Errorf("end time was invalid: %v", err)
 	}
 	lr.end = time.Date(now.Year(), now.Month(), now.Day(), end.Hour(), end.Minute(), 0, 0, time.Local)
 
@@ -193,10 +321,21 @@ func NewLimitTransport(logger utils.Logger, rt http.RoundTripper, lr LimitRange,
 		filesize:   filesize,
 		rateLimit:  ratelimit,
 	}
+	lt.reader.smoothing = DefaultRateSmoothing
 
 	return lt, nil
 }
 
+// uploadKey marks the context of the video upload request. See WithUpload
+type uploadKey struct{}
+
+// WithUpload returns a copy of ctx that marks requests made with it as the video upload. Only
+// their media is limited and monitored, so that other media, such as captions, sent over the
+// same LimitTransport doesn't get mixed up with the video
+func WithUpload(ctx context.Context) context.Context {
+	return context.WithValue(ctx, uploadKey{}, true)
+}
+
 // HasStarted returns whether the LimitTransport has seen use
 func (t *LimitTransport) HasStarted() bool {
 	t.reader.Lock()
@@ -207,12 +346,21 @@ func (t *LimitTransport) HasStarted() bool {
 func (t *LimitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 
 	contentType := r.Header.Get("Content-Type")
+	isUpload := false
 
 	// FIXME: this is messy. Need a better way to detect roundtrip associated with video upload
-	if strings.HasPrefix(contentType, "multipart/related") ||
-		strings.HasPrefix(contentType, "video") ||
-		strings.HasPrefix(contentType, "application/octet-stream") ||
-		r.Header.Get("X-Upload-Content-Type") == "application/octet-stream" {
+	if r.Context().Value(uploadKey{}) != nil &&
+		(strings.HasPrefix(contentType, "multipart/related") ||
+			strings.HasPrefix(contentType, "video") ||
+			strings.HasPrefix(contentType, "application/octet-stream") ||
+			r.Header.Get("X-Upload-Content-Type") == "application/octet-stream") {
+
+		if err := t.waitForWindow(r); err != nil {
+			if r.Body != nil {
+				r.Body.Close()
+			}
+			return nil, err
+		}
 
 		t.reader.Lock()
 		if !t.readerInit {
@@ -230,17 +378,60 @@ func (t *LimitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 		t.reader.ReadCloser = r.Body
 		r.Body = &t.reader
 
+		if start, end, ok := parseContentRange(r.Header.Get("Content-Range")); ok {
+			t.reader.status.trackChunk(start, end)
+			if t.reader.status.ChunkRetry > 0 {
+				t.logRetry()
+				if err := t.spendRetry(); err != nil {
+					t.reader.Unlock()
+					r.Body.Close()
+					return nil, err
+				}
+			}
+		}
+		t.lastStart = time.Now()
+
 		t.reader.Unlock()
+		isUpload = true
 	}
 
 	if contentType != "" {
 		t.logger.Debugf("Content-Type header value %q\n", contentType)
 	}
+	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+		start, end, ok := parseContentRange(contentRange)
+		t.logger.Debugf("Content-Range header value %q%s\n", contentRange, describeRange(start, end, ok))
+	}
 	t.logger.Debugf("Requesting URL %q\n", r.URL)
 
+	var stopWatchdog func() bool
+	if isUpload && t.idleTimeout > 0 {
+		r, stopWatchdog = t.watchIdle(r)
+	}
+
 	resp, err := t.transport.RoundTrip(r)
+	if stopWatchdog != nil && stopWatchdog() && err != nil {
+		fmt.Printf("\nNo data was sent for %s. Abandoning the request...\n", t.idleTimeout)
+		err = fmt.Errorf("%w for %s: %w", ErrIdle, t.idleTimeout, io.ErrUnexpectedEOF)
+	}
+	if isUpload {
+		t.reader.Lock()
+		if err != nil {
+			t.lastResult = err.Error()
+		} else {
+			t.lastResult = resp.Status
+		}
+		t.lastEnd = time.Now()
+		t.reader.Unlock()
+	}
 	if err == nil {
 		t.logger.Debugf("Response status code: %d\n", resp.StatusCode)
+		t.recordUploadID(resp)
+		// for a resumable upload, Range is the data the server has received so far
+		if received := resp.Header.Get("Range"); isUpload && received != "" {
+			start, end, ok := parseContentRange(strings.Replace(received, "bytes=", "bytes ", 1))
+			t.logger.Debugf("Range header value %q%s\n", received, describeRange(start, end, ok))
+		}
 		if resp.Body != nil {
 			respBytes, err := httputil.DumpResponse(resp, true)
 			if err != nil {
@@ -254,6 +445,143 @@ func (t *LimitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	return resp, err
 }
 
+// SetRateLimit changes the upload rate limit in Kbps, taking effect immediately if an upload
+// is in progress. Zero removes the limit. Any bandwidth share is cancelled
+func (t *LimitTransport) SetRateLimit(kbps int) error {
+	if kbps < 0 {
+		return fmt.Errorf("rate limit can't be negative")
+	}
+	t.reader.Lock()
+	defer t.reader.Unlock()
+
+	t.rateLimit = kbps
+	t.reader.bandwidthShare = 0
+	if t.readerInit {
+		t.reader.rateLimit = kbps
+		// if there's no limiter yet, one is created on the next read
+		if t.reader.limiter != nil && kbps > 0 {
+			t.reader.limiter.SetLimit(rate.Limit(kbps * 125))
+		}
+	}
+	return nil
+}
+
+// SetBandwidthShare limits the upload rate to percent of the bandwidth measured during
+// the first probe duration of the upload. It replaces any fixed rate limit
+func (t *LimitTransport) SetBandwidthShare(percent int, probe time.Duration) error {
+	if percent < 1 || percent > 100 {
+		return fmt.Errorf("bandwidth share must be between 1 and 100 percent")
+	}
+	t.reader.Lock()
+	defer t.reader.Unlock()
+	t.rateLimit = 0
+	t.reader.bandwidthShare = percent
+	t.reader.probeDuration = probe
+	return nil
+}
+
+// SetRateSmoothing sets the weight, between 0 and 1, given to each new rate sample when
+// estimating the time remaining. Higher values follow changes in speed more closely, lower
+// values give a steadier estimate. Zero uses the average rate over the whole upload
+func (t *LimitTransport) SetRateSmoothing(factor float64) error {
+	if factor < 0 || factor > 1 {
+		return fmt.Errorf("rate smoothing must be between 0 and 1")
+	}
+	t.reader.Lock()
+	defer t.reader.Unlock()
+	t.reader.smoothing = factor
+	return nil
+}
+
+// SetRetryLog sets a writer that each resent upload chunk is recorded to, in addition to the debug log
+func (t *LimitTransport) SetRetryLog(w io.Writer) {
+	t.reader.Lock()
+	defer t.reader.Unlock()
+	t.retryLog = w
+}
+
+// logRetry records a resent chunk. The reader lock must be held
+func (t *LimitTransport) logRetry() {
+	var delay time.Duration
+	if !t.lastEnd.IsZero() {
+		delay = time.Since(t.lastEnd).Round(time.Millisecond)
+	}
+	msg := fmt.Sprintf("chunk %d attempt %d: previous attempt failed with %q, retrying after %s",
+		t.reader.status.Chunk, t.reader.status.ChunkRetry+1, t.lastResult, delay)
+
+	t.logger.Debugf("Retry %s\n", msg)
+	if t.retryLog != nil {
+		fmt.Fprintf(t.retryLog, "%s %s\n", time.Now().Format(time.RFC3339), msg)
+	}
+}
+
+// trackChunk updates the chunk counters from the byte range of a resumable upload request
+func (s *Status) trackChunk(start, end int64) {
+	if s.chunkSize == 0 {
+		// all chunks except the last are the same size
+		s.chunkSize = end - start + 1
+		s.chunkStart = -1
+	}
+
+	if start == s.chunkStart {
+		s.ChunkRetry++
+		s.Retries++
+	} else {
+		s.ChunkRetry = 0
+	}
+	s.chunkStart = start
+
+	s.Chunk = int(start/s.chunkSize) + 1
+	if s.TotalBytes > 0 {
+		s.Chunks = int((int64(s.TotalBytes) + s.chunkSize - 1) / s.chunkSize)
+	}
+}
+
+// parseContentRange extracts the byte range from a Content-Range request header e.g. "bytes 0-1023/*"
+func parseContentRange(header string) (start, end int64, ok bool) {
+	rng, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	rng, _, _ = strings.Cut(rng, "/")
+	startStr, endStr, found := strings.Cut(rng, "-")
+	if !found {
+		// "bytes */total" is a status query, not a chunk
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err = strconv.ParseInt(endStr, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// describeRange formats a byte range parsed by parseContentRange for the debug log,
+// or returns an empty string if it wasn't parsed
+func describeRange(start, end int64, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf(" (%s to %s, %s)", formatBytes(start), formatBytes(end+1), formatBytes(end-start+1))
+}
+
+// formatBytes formats n bytes in the largest binary unit that keeps it above 1
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
 func (t *LimitTransport) GetMonitorStatus() Status {
 	t.reader.Lock()
 	defer t.reader.Unlock()
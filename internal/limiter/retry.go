@@ -0,0 +1,51 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package limiter
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRetryDuration is returned by an upload request that would have retried a chunk after the
+// maximum retry duration had been used up. It isn't retried, so the upload fails
+var ErrRetryDuration = errors.New("maximum retry duration reached")
+
+// SetMaxRetryDuration limits the total time spent retrying chunks of a resumable upload, counted
+// from the start of each failed attempt, so including the backoff between attempts. Once it's used
+// up, the next retry fails with ErrRetryDuration. Zero means no limit
+func (t *LimitTransport) SetMaxRetryDuration(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("maximum retry duration can't be negative")
+	}
+	t.reader.Lock()
+	defer t.reader.Unlock()
+	t.maxRetryDuration = d
+	return nil
+}
+
+// spendRetry adds the time since the previous attempt of the current chunk started to the time
+// spent retrying, returning ErrRetryDuration once that's more than the maximum. The reader lock must be held
+func (t *LimitTransport) spendRetry() error {
+	if !t.lastStart.IsZero() {
+		t.retrySpent += time.Since(t.lastStart)
+	}
+	if t.maxRetryDuration > 0 && t.retrySpent > t.maxRetryDuration {
+		return fmt.Errorf("%w: chunk %d has been retried %d times, and %s has been spent retrying", ErrRetryDuration,
+			t.reader.status.Chunk, t.reader.status.ChunkRetry, t.retrySpent.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package limiter
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// SetUploadIDHandler sets a function that's called with the upload ID of a resumable upload, once
+// YouTube has started the upload session. Uploads small enough to be sent in one request don't have one
+func (t *LimitTransport) SetUploadIDHandler(handler func(id string)) {
+	t.reader.Lock()
+	defer t.reader.Unlock()
+	t.uploadIDHandler = handler
+}
+
+// UploadID returns the upload ID of the resumable upload session, or "" if one hasn't been started
+func (t *LimitTransport) UploadID() string {
+	t.reader.Lock()
+	defer t.reader.Unlock()
+	return t.uploadID
+}
+
+// recordUploadID looks for the upload ID in the session URI returned when a resumable upload starts
+func (t *LimitTransport) recordUploadID(resp *http.Response) {
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return
+	}
+	id := location.Query().Get("upload_id")
+	if id == "" {
+		return
+	}
+
+	t.reader.Lock()
+	handler := t.uploadIDHandler
+	isNew := id != t.uploadID
+	t.uploadID = id
+	t.reader.Unlock()
+
+	t.logger.Debugf("Upload ID %q\n", id)
+	if isNew && handler != nil {
+		handler(id)
+	}
+}
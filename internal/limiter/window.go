@@ -0,0 +1,66 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package limiter
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SetUploadWindow makes upload requests wait until the daily window lr is open, so that the
+// upload starts when it opens and pauses when it closes. The upload is paused between chunks,
+// so a request already being sent when the window closes is finished. A zero LimitRange disables this
+func (t *LimitTransport) SetUploadWindow(lr LimitRange) {
+	t.reader.Lock()
+	defer t.reader.Unlock()
+	t.uploadWindow = lr
+}
+
+// untilOpen returns how long after now the daily window next opens, or zero if it's open
+func (lr LimitRange) untilOpen(now time.Time) time.Duration {
+	if lr.start.IsZero() || lr.end.IsZero() {
+		return 0
+	}
+	day := 24 * time.Hour
+	offset := now.Sub(lr.start) % day
+	if offset < 0 {
+		offset += day
+	}
+	if offset < lr.end.Sub(lr.start) {
+		return 0
+	}
+	return day - offset
+}
+
+// waitForWindow blocks until the upload window is open, or r's context is done
+func (t *LimitTransport) waitForWindow(r *http.Request) error {
+	t.reader.Lock()
+	wait := t.uploadWindow.untilOpen(time.Now())
+	t.reader.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	fmt.Printf("\nOutside the upload window. Waiting until %s...\n", time.Now().Add(wait).Format("15:04"))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/porjo/youtubeuploader/internal/limiter"
+)
+
+// Metrics tracks upload outcomes and progress, and serves them in the
+// Prometheus text exposition format
+type Metrics struct {
+	mu sync.Mutex
+
+	succeeded int
+	failed    int
+	// bytes and retries from finished uploads
+	bytes   int64
+	retries int
+
+	// transport of the upload in progress
+	transport *limiter.LimitTransport
+}
+
+func New() *Metrics {
+	return &Metrics{}
+}
+
+// SetTransport sets the transport of the upload in progress
+func (m *Metrics) SetTransport(t *limiter.LimitTransport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transport = t
+}
+
+// UploadFinished records the outcome of the upload using the current transport
+func (m *Metrics) UploadFinished(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.failed++
+	} else {
+		m.succeeded++
+	}
+	if m.transport != nil {
+		s := m.transport.GetMonitorStatus()
+		m.bytes += int64(s.Bytes)
+		m.retries += s.Retries
+		m.transport = nil
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	succeeded, failed, bytes, retries := m.succeeded, m.failed, m.bytes, m.retries
+	var rate int
+	if m.transport != nil && m.transport.HasStarted() {
+		s := m.transport.GetMonitorStatus()
+		bytes += int64(s.Bytes)
+		retries += s.Retries
+		rate = s.AvgRate
+	}
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "youtubeuploader_uploads_total", "counter", "Number of finished uploads.", "")
+	fmt.Fprintf(w, "youtubeuploader_uploads_total{result=\"success\"} %d\n", succeeded)
+	fmt.Fprintf(w, "youtubeuploader_uploads_total{result=\"failure\"} %d\n", failed)
+	writeMetric(w, "youtubeuploader_uploaded_bytes_total", "counter", "Bytes of video data uploaded.", fmt.Sprint(bytes))
+	writeMetric(w, "youtubeuploader_upload_rate_bytes", "gauge", "Average rate of the upload in progress, in bytes per second.", fmt.Sprint(rate))
+	writeMetric(w, "youtubeuploader_chunk_retries_total", "counter", "Number of upload chunks that were resent.", fmt.Sprint(retries))
+}
+
+// writeMetric writes the HELP and TYPE lines for a metric, followed by its value if there is one
+func writeMetric(w http.ResponseWriter, name, kind, help, value string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	if value != "" {
+		fmt.Fprintf(w, "%s %s\n", name, value)
+	}
+}
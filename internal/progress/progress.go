@@ -16,10 +16,13 @@ package progress
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/porjo/youtubeuploader/internal/limiter"
 )
@@ -29,9 +32,33 @@ type Progress struct {
 	interval  time.Duration
 	quiet     bool
 
+	// width is the maximum length of the status line. Zero means detect the terminal width
+	width int
 	erase int
+
+	// events receives an Event for each progress update, if set
+	events io.Writer
+}
+
+// Event is a progress update, written as a line of JSON to the writer given to SetEvents
+type Event struct {
+	// Time is when the update was made, in RFC 3339 format
+	Time       string `json:"time"`
+	Bytes      int    `json:"bytes"`
+	TotalBytes int    `json:"totalBytes"`
+	Progress   string `json:"progress"`
+	// Rate is in bytes per second. ETA is in seconds, and is only set once the rate is stable
+	Rate    int     `json:"rate"`
+	ETA     float64 `json:"eta,omitempty"`
+	Elapsed float64 `json:"elapsed"`
+	Chunk   int     `json:"chunk,omitempty"`
+	Chunks  int     `json:"chunks,omitempty"`
+	Retries int     `json:"retries,omitempty"`
 }
 
+// defaultWidth is used when the terminal width can't be detected
+const defaultWidth = 80
+
 func NewProgress(transport *limiter.LimitTransport, interval time.Duration) (*Progress, error) {
 	if transport == nil {
 		return nil, fmt.Errorf("transport cannot be nil")
@@ -50,6 +77,17 @@ func NewProgress(transport *limiter.LimitTransport, interval time.Duration) (*Pr
 	return p, nil
 }
 
+// SetEvents sets a writer to receive each progress update as a JSON Event, whether or
+// not the progress is being output
+func (p *Progress) SetEvents(w io.Writer) {
+	p.events = w
+}
+
+// SetWidth sets the maximum length of the status line. Zero detects the terminal width
+func (p *Progress) SetWidth(width int) {
+	p.width = width
+}
+
 func (p *Progress) Run(ctx context.Context, signalChan chan os.Signal) {
 
 	var ticker *time.Ticker
@@ -69,6 +107,9 @@ func (p *Progress) Run(ctx context.Context, signalChan chan os.Signal) {
 			if !p.quiet {
 				p.Output()
 			}
+			if p.events != nil {
+				p.writeEvent()
+			}
 		case <-signalChan:
 			// output on demand
 			p.Output()
@@ -87,21 +128,88 @@ func (p *Progress) Output() {
 	s := p.transport.GetMonitorStatus()
 	avgRate := float64(s.AvgRate)
 	elapsed := time.Since(s.Start).Round(time.Second)
+
+	eta := "calculating…"
+	if s.TotalBytes == 0 {
+		eta = "n/a"
+	} else if s.RateStable {
+		eta = s.TimeRem.String()
+	}
+
 	var status string
 	if avgRate >= 125000 {
 		// Bytes/s -> Megabits/s = Bbps/125000
-		status = fmt.Sprintf("Progress: %6.2f Mbit/s (%5.2f MiB/s), %dk / %dk (%s) ETA %4s, Elapsed %s", avgRate/125000, avgRate/(1024*1024), s.Bytes/1024, s.TotalBytes/1024, s.Progress, s.TimeRem, elapsed)
+		status = fmt.Sprintf("Progress: %6.2f Mbit/s (%5.2f MiB/s), %dk / %dk (%s) ETA %4s, Elapsed %s", avgRate/125000, avgRate/(1024*1024), s.Bytes/1024, s.TotalBytes/1024, s.Progress, eta, elapsed)
 	} else {
 		// Bytes/s -> Kilobits/s = Bbps/125
-		status = fmt.Sprintf("Progress: %6.f Kbit/s (%5.f KiB/s), %dk / %dk (%s) ETA %4s, Elapsed %s", avgRate/125, avgRate/1024, s.Bytes/1024, s.TotalBytes/1024, s.Progress, s.TimeRem, elapsed)
+		status = fmt.Sprintf("Progress: %6.f Kbit/s (%5.f KiB/s), %dk / %dk (%s) ETA %4s, Elapsed %s", avgRate/125, avgRate/1024, s.Bytes/1024, s.TotalBytes/1024, s.Progress, eta, elapsed)
+	}
+
+	if s.Chunk > 0 {
+		if s.Chunks > 0 {
+			status += fmt.Sprintf(", chunk %d/%d", s.Chunk, s.Chunks)
+		} else {
+			status += fmt.Sprintf(", chunk %d", s.Chunk)
+		}
+		if s.ChunkRetry > 0 {
+			status += fmt.Sprintf(" (retry %d)", s.ChunkRetry)
+		}
 	}
 
 	if p.quiet {
 		// Don't erase to start of line for on-demand status output
 		fmt.Printf("%s\n", status)
 	} else {
+		// a line that wraps can't be erased with '\r', so keep it shorter than the terminal
+		width := p.width
+		if width == 0 {
+			width = terminalWidth()
+			if width == 0 {
+				width = defaultWidth
+			}
+		}
+		status = truncate(status, width-1)
+
 		// erase to start of line, then output status
 		fmt.Printf("\r%s\r%s", strings.Repeat(" ", p.erase), status)
-		p.erase = len(status)
+		p.erase = utf8.RuneCountInString(status)
+	}
+}
+
+// writeEvent writes the current status to p.events
+func (p *Progress) writeEvent() {
+	if !p.transport.HasStarted() {
+		return
+	}
+
+	s := p.transport.GetMonitorStatus()
+	event := Event{
+		Time:       time.Now().Format(time.RFC3339),
+		Bytes:      s.Bytes,
+		TotalBytes: s.TotalBytes,
+		Progress:   s.Progress,
+		Rate:       s.AvgRate,
+		Elapsed:    time.Since(s.Start).Seconds(),
+		Chunk:      s.Chunk,
+		Chunks:     s.Chunks,
+		Retries:    s.Retries,
+	}
+	if s.TotalBytes > 0 && s.RateStable {
+		event.ETA = s.TimeRem.Seconds()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	p.events.Write(append(data, '\n'))
+}
+
+// truncate shortens s to at most n characters, marking the cut with an ellipsis
+func truncate(s string, n int) string {
+	if n < 1 || utf8.RuneCountInString(s) <= n {
+		return s
 	}
+	r := []rune(s)
+	return string(r[:n-1]) + "…"
 }
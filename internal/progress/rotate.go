@@ -0,0 +1,104 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package progress
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingWriter appends to a file. Once the file reaches its maximum size it's renamed with a
+// ".1" suffix, replacing the previous one, and a new file is started. At most two files are kept
+type RotatingWriter struct {
+	mu       sync.Mutex
+	filename string
+	maxSize  int64
+	file     *os.File
+	size     int64
+}
+
+// NewRotatingWriter returns a writer that appends to filename, rotating it once it's larger
+// than maxSize bytes. Zero means the file is never rotated
+func NewRotatingWriter(filename string, maxSize int64) *RotatingWriter {
+	return &RotatingWriter{filename: filename, maxSize: maxSize}
+}
+
+// Write appends p to the file, rotating it first if p would take it over the maximum size.
+// p is never split across files
+func (r *RotatingWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		err := r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the file. A later write opens it again
+func (r *RotatingWriter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *RotatingWriter) open() error {
+	file, err := os.OpenFile(r.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening progress file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error opening progress file: %w", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingWriter) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err != nil {
+		return fmt.Errorf("error rotating progress file: %w", err)
+	}
+	// on Windows the rename doesn't replace an existing file
+	_ = os.Remove(r.filename + ".1")
+	err = os.Rename(r.filename, r.filename+".1")
+	if err != nil {
+		return fmt.Errorf("error rotating progress file: %w", err)
+	}
+	return r.open()
+}
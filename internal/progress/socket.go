@@ -0,0 +1,78 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package progress
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// socketWriteTimeout stops a listener that isn't reading from holding up the upload
+const socketWriteTimeout = time.Second
+
+// SocketWriter writes to a Unix domain socket, for a local program that displays the progress.
+// It connects on the first write, and again after the connection is lost, so the listener
+// can start or restart at any time. Data written while there's no listener is dropped
+type SocketWriter struct {
+	mu     sync.Mutex
+	path   string
+	conn   net.Conn
+	closed bool
+}
+
+func NewSocketWriter(path string) *SocketWriter {
+	return &SocketWriter{path: path}
+}
+
+// Write sends p to the socket. It never fails, as progress updates are expendable
+func (s *SocketWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return len(p), nil
+	}
+	if s.conn == nil {
+		conn, err := net.DialTimeout("unix", s.path, socketWriteTimeout)
+		if err != nil {
+			return len(p), nil
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	_, err := s.conn.Write(p)
+	if err != nil {
+		// the listener has gone away. Reconnect on the next write
+		s.conn.Close()
+		s.conn = nil
+	}
+	return len(p), nil
+}
+
+// Close closes the connection, if there is one. Later writes are dropped
+func (s *SocketWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
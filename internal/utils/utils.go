@@ -14,12 +14,28 @@ limitations under the License.
 
 package utils
 
-import "log"
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
 
 type Logger struct {
 	debug bool
 }
 
+// LogBuffer holds log output in memory until it is flushed.
+// It can be used with log.SetOutput to only show logs when something goes wrong.
+type LogBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
 func NewLogger(debug bool) Logger {
 	return Logger{debug: debug}
 }
@@ -29,3 +45,61 @@ func (l *Logger) Debugf(format string, args ...interface{}) {
 		log.Printf("[DEBUG] "+format, args...)
 	}
 }
+
+// IsTerminal reports whether f is attached to an interactive terminal
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Flush writes the buffered output to w and empties the buffer
+func (b *LogBuffer) Flush(w io.Writer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.buf.WriteTo(w)
+	return err
+}
+
+// sizeUnits are the suffixes accepted by ParseSize. They're all powers of 1024
+var sizeUnits = []struct {
+	suffix string
+	bytes  int
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+// ParseSize parses a size in bytes with an optional suffix e.g. "256KB", "8MiB" or "1G".
+// KB, MB and GB are treated the same as KiB, MiB and GiB. A bare integer is a number of bytes
+func ParseSize(s string) (int, error) {
+	number := strings.TrimSpace(s)
+	multiplier := 1
+	upper := strings.ToUpper(number)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(upper, unit.suffix) {
+			number = strings.TrimSpace(number[:len(number)-len(unit.suffix)])
+			multiplier = unit.bytes
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > 0 && multiplier > 1 && n > int(^uint(0)>>1)/multiplier {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * multiplier, nil
+}
@@ -20,12 +20,14 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pkg/browser"
@@ -48,11 +50,35 @@ For more information about the client_secrets.json file format, please visit:
 https://developers.google.com/api-client-library/python/guide/aaa_client_secrets`
 
 	callbackTimeout = 120 * time.Second
+
+	// the authorization code exchange is retried on network and server errors
+	exchangeAttempts   = 3
+	exchangeRetryDelay = time.Second
+
+	// the token cache lock is waited on for lockTimeout. Locks older than staleLockAge
+	// were left behind by a process that didn't exit cleanly, and are removed
+	lockTimeout  = 10 * time.Second
+	lockPoll     = 50 * time.Millisecond
+	staleLockAge = time.Minute
+
+	// oAuthSuccessHTML is shown in the browser once authorization is complete
+	oAuthSuccessHTML = `<!DOCTYPE html>
+<html>
+<head><title>youtubeuploader</title></head>
+<body>
+<h3>Authorization complete</h3>
+<p>You can now close this window.</p>
+</body>
+</html>
+`
 )
 
 var (
 	clientSecretsFile = flag.String("secrets", "client_secrets.json", "Client Secrets configuration")
 	cache             = flag.String("cache", "request.token", "token cache file")
+	oAuthSuccessPage  = flag.String("oAuthSuccessPage", "", "HTML file shown in the browser once authorization is complete (optional)")
+	inlineToken       = flag.String("token", "", "OAuth token JSON to use instead of the token cache. It's only saved if -cache is also given")
+	tokenFile         = flag.String("tokenFile", "", "file containing the OAuth token JSON to use instead of the token cache. The file isn't written to")
 )
 
 // CallbackStatus is returned from the oauth2 callback
@@ -152,6 +178,18 @@ func readConfig(scopes []string) (*oauth2.Config, error) {
 	return oCfg, nil
 }
 
+// successPage returns the page shown once authorization is complete
+func successPage() []byte {
+	if *oAuthSuccessPage != "" {
+		page, err := os.ReadFile(*oAuthSuccessPage)
+		if err == nil {
+			return page
+		}
+		log.Printf("Error reading OAuth success page: %s\n", err)
+	}
+	return []byte(oAuthSuccessHTML)
+}
+
 // startCallbackWebServer starts a web server that listens on http://localhost:8080.
 // The webserver waits for an oauth code in the three-legged auth flow.
 func startCallbackWebServer(ctx context.Context, oAuthPort int) (callbackCh chan CallbackStatus, err error) {
@@ -174,7 +212,9 @@ func startCallbackWebServer(ctx context.Context, oAuthPort int) (callbackCh chan
 			cbs.state = r.FormValue("state")
 			cbs.code = r.FormValue("code")
 			callbackCh <- cbs // send code to OAuth flow
-			fmt.Fprintf(w, "Received code: %v\r\nYou can now safely close this browser window.", cbs.code)
+			// the code isn't shown, to keep it out of the browser history
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(successPage())
 			if f, ok := w.(http.Flusher); ok {
 				f.Flush()
 			}
@@ -220,19 +260,17 @@ func startCallbackWebServer(ctx context.Context, oAuthPort int) (callbackCh chan
 // It returns an instance of an HTTP client that can be passed to the
 // constructor of the YouTube client.
 func BuildOAuthHTTPClient(ctx context.Context, scopes []string, oAuthPort int) (*http.Client, error) {
-	config, err := readConfig(scopes)
-	if err != nil {
-		msg := fmt.Sprintf("Cannot read configuration file: %v", err)
-		return nil, errors.New(msg)
-	}
+	return buildOAuthHTTPClient(ctx, scopes, oAuthPort, "")
+}
 
-	// Check if supplied token cache file exists
-	// fallback to reading from OS specific default config dir
-	_, err = os.Stat(*cache)
+// defaultCacheFile returns the -cache file. If it doesn't exist, the token cache in the OS specific
+// config dir is used instead when there's one there
+func defaultCacheFile() (string, error) {
+	_, err := os.Stat(*cache)
 	if err != nil && errors.Is(err, fs.ErrNotExist) {
 		confDir, err := os.UserConfigDir()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 		cachePath := filepath.Join(confDir, "youtubeuploader", "request.token")
 		_, err = os.Stat(cachePath)
@@ -242,12 +280,45 @@ func BuildOAuthHTTPClient(ctx context.Context, scopes []string, oAuthPort int) (
 			*cache = cachePath
 		}
 	}
+	return *cache, nil
+}
+
+// buildOAuthHTTPClient is BuildOAuthHTTPClient with the token cache stored in cacheFile.
+// If cacheFile is empty, the -cache flag is used
+func buildOAuthHTTPClient(ctx context.Context, scopes []string, oAuthPort int, cacheFile string) (*http.Client, error) {
+	config, err := readConfig(scopes)
+	if err != nil {
+		msg := fmt.Sprintf("Cannot read configuration file: %v", err)
+		return nil, errors.New(msg)
+	}
+
+	// a token given on the command line is used instead of the default cache
+	if cacheFile == "" && (*inlineToken != "" || *tokenFile != "") {
+		token, err := suppliedToken()
+		if err != nil {
+			return nil, err
+		}
+		if flagSet("cache") {
+			err = CacheFile(*cache).PutToken(token)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return config.Client(ctx, token), nil
+	}
+
+	if cacheFile == "" {
+		cacheFile, err = defaultCacheFile()
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Try to read the token from the cache file.
 	// If an error occurs, do the three-legged OAuth flow because
 	// the token is invalid or doesn't exist.
-	tokenCache := CacheFile(*cache)
-	token, err := tokenCache.Token()
+	tokenCache := CacheFile(cacheFile)
+	token, err := tokenCache.ValidToken(ctx, config)
 	if err == nil {
 		return config.Client(ctx, token), nil
 	}
@@ -284,7 +355,7 @@ func BuildOAuthHTTPClient(ctx context.Context, scopes []string, oAuthPort int) (
 		return nil, fmt.Errorf("expecting state %q, received state %q", randState, cbs.state)
 	}
 
-	token, err = config.Exchange(context.TODO(), cbs.code)
+	token, err = ExchangeToken(ctx, config, cbs.code)
 	if err != nil {
 		return nil, err
 	}
@@ -296,8 +367,205 @@ func BuildOAuthHTTPClient(ctx context.Context, scopes []string, oAuthPort int) (
 	return config.Client(ctx, token), nil
 }
 
+// lock serializes access to the token cache between processes sharing it. A lock file
+// is created next to the cache file and removed by the returned unlock function
+func (f CacheFile) lock() (unlock func(), err error) {
+	lockFile := string(f) + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		file, err := os.OpenFile(lockFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(file, "%d\n", os.Getpid())
+			file.Close()
+			return func() { os.Remove(lockFile) }, nil
+		}
+		if errors.Is(err, fs.ErrPermission) {
+			// the cache may be in a read-only location, where it can't be written to anyway
+			return func() {}, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(lockFile); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(lockFile)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock file %q", lockFile)
+		}
+		time.Sleep(lockPoll)
+	}
+}
+
+// ExchangeToken exchanges the authorization code for a token. Network and server errors are
+// retried, so that a brief outage doesn't require authorizing in the browser again.
+// Other errors, such as invalid_grant, are returned straight away
+func ExchangeToken(ctx context.Context, config *oauth2.Config, code string) (*oauth2.Token, error) {
+	var token *oauth2.Token
+	err := retry(exchangeAttempts, exchangeRetryDelay, func() error {
+		var err error
+		token, err = config.Exchange(ctx, code)
+		if err != nil && isTransient(err) {
+			fmt.Printf("Token exchange failed: %s. Retrying...\n", err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging authorization code: %w", err)
+	}
+	return token, nil
+}
+
+// suppliedToken reads the token given by the -token or -tokenFile flag
+func suppliedToken() (*oauth2.Token, error) {
+	if *inlineToken != "" && *tokenFile != "" {
+		return nil, errors.New("-token and -tokenFile can't be used together")
+	}
+	data := []byte(*inlineToken)
+	if *tokenFile != "" {
+		var err error
+		data, err = os.ReadFile(*tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading token file: %w", err)
+		}
+	}
+	token := &oauth2.Token{}
+	err := json.Unmarshal(data, token)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing token: %w", err)
+	}
+	if token.AccessToken == "" && token.RefreshToken == "" {
+		return nil, errors.New("token has no access or refresh token")
+	}
+	return token, nil
+}
+
+// flagSet reports whether the named flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// DumpToken writes a description of the OAuth token that would be used for uploads to w: its
+// expiry, whether it can be refreshed and its scopes. The token values themselves aren't shown.
+// The token is read from -token or -tokenFile if given, otherwise from the cacheFile token cache,
+// or the -cache file if cacheFile is empty
+func DumpToken(w io.Writer, cacheFile string) error {
+	var source string
+	var token *oauth2.Token
+	var err error
+	if *inlineToken != "" || *tokenFile != "" {
+		source = "-token"
+		if *tokenFile != "" {
+			source = *tokenFile
+		}
+		token, err = suppliedToken()
+	} else {
+		source = cacheFile
+		if source == "" {
+			source, err = defaultCacheFile()
+			if err != nil {
+				return err
+			}
+		}
+		token, err = CacheFile(source).Token()
+	}
+	if err != nil {
+		return err
+	}
+
+	raw := []byte(*inlineToken)
+	if source != "-token" {
+		raw, _ = os.ReadFile(source)
+	}
+
+	fmt.Fprintf(w, "Token:         %s\n", source)
+	fmt.Fprintf(w, "Type:          %s\n", token.Type())
+	fmt.Fprintf(w, "Access token:  %s\n", present(token.AccessToken))
+	fmt.Fprintf(w, "Refresh token: %s\n", present(token.RefreshToken))
+	switch {
+	case token.Expiry.IsZero():
+		fmt.Fprintf(w, "Expiry:        none\n")
+	case time.Now().After(token.Expiry):
+		fmt.Fprintf(w, "Expiry:        %s (expired %s ago)\n", token.Expiry.Local().Format(time.DateTime), time.Since(token.Expiry).Round(time.Second))
+	default:
+		fmt.Fprintf(w, "Expiry:        %s (in %s)\n", token.Expiry.Local().Format(time.DateTime), time.Until(token.Expiry).Round(time.Second))
+	}
+
+	// the scopes are only there if the token came from somewhere that recorded them
+	var fields struct {
+		Scope string `json:"scope"`
+	}
+	if json.Unmarshal(raw, &fields) == nil && fields.Scope != "" {
+		fmt.Fprintf(w, "Scopes:        %s\n", strings.Join(strings.Fields(fields.Scope), ", "))
+	} else {
+		fmt.Fprintf(w, "Scopes:        not recorded. youtubeuploader asks for %s\n", strings.Join(uploadScopes, ", "))
+	}
+
+	if token.RefreshToken == "" && !token.Valid() {
+		fmt.Fprintf(w, "\nThe token has expired and can't be refreshed. Delete it and run youtubeuploader again to reauthorize\n")
+	} else if token.RefreshToken != "" && !token.Valid() {
+		fmt.Fprintf(w, "\nThe access token has expired, and will be refreshed when it's next used. If refreshing fails with\n"+
+			"\"Token has been expired or revoked\", delete the token and run youtubeuploader again to reauthorize\n")
+	}
+	return nil
+}
+
+// present describes whether a secret value is set, without showing it
+func present(value string) string {
+	if value == "" {
+		return "missing"
+	}
+	return "present"
+}
+
+// ValidToken retrieves the token from the token cache, refreshing it if it has expired. If the refresh
+// token has been revoked or has expired (invalid_grant), the cache file is renamed with a ".bak" suffix,
+// so that it's kept for debugging while a new token is requested, and an error is returned.
+// Other refresh errors are left for the first API call to report
+func (f CacheFile) ValidToken(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	token, err := f.Token()
+	if err != nil || token.Valid() {
+		return token, err
+	}
+
+	refreshed, err := config.TokenSource(ctx, token).Token()
+	if err == nil {
+		return refreshed, nil
+	}
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) || retrieveErr.ErrorCode != "invalid_grant" {
+		return token, nil
+	}
+
+	backup := string(f) + ".bak"
+	unlock, lockErr := f.lock()
+	if lockErr != nil {
+		return nil, fmt.Errorf("CacheFile.ValidToken: %w", lockErr)
+	}
+	defer unlock()
+	// on Windows the rename doesn't replace an existing backup
+	_ = os.Remove(backup)
+	if renameErr := os.Rename(string(f), backup); renameErr != nil {
+		return nil, fmt.Errorf("the cached token has been revoked or has expired, and it couldn't be moved aside: %w", renameErr)
+	}
+	fmt.Printf("The cached token has been revoked or has expired. It has been moved to %q, and a new one will be requested\n", backup)
+	return nil, fmt.Errorf("cached token is no longer valid: %w", err)
+}
+
 // Token retreives the token from the token cache
 func (f CacheFile) Token() (*oauth2.Token, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, fmt.Errorf("CacheFile.Token: %w", err)
+	}
+	defer unlock()
+
 	file, err := os.Open(string(f))
 	if err != nil {
 		return nil, fmt.Errorf("CacheFile.Token: %w", err)
@@ -312,6 +580,12 @@ func (f CacheFile) Token() (*oauth2.Token, error) {
 
 // PutToken stores the token in the token cache
 func (f CacheFile) PutToken(tok *oauth2.Token) error {
+	unlock, err := f.lock()
+	if err != nil {
+		return fmt.Errorf("CacheFile.PutToken: %w", err)
+	}
+	defer unlock()
+
 	file, err := os.OpenFile(string(f), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("CacheFile.PutToken: %w", err)
@@ -15,17 +15,23 @@ limitations under the License.
 package youtubeuploader
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/porjo/youtubeuploader/internal/limiter"
 	"github.com/porjo/youtubeuploader/internal/progress"
+	"github.com/porjo/youtubeuploader/internal/utils"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
@@ -33,35 +39,134 @@ import (
 )
 
 func Run(ctx context.Context, transport *limiter.LimitTransport, config Config, videoReader io.ReadCloser) error {
+	_, err := Upload(ctx, transport, config, videoReader)
+	return err
+}
+
+// Upload uploads the video read from videoReader, returning the uploaded video, or nil if the
+// upload was skipped. The video is returned along with any error from the steps that follow the
+// upload e.g. setting the thumbnail or adding to playlists
+func Upload(ctx context.Context, transport *limiter.LimitTransport, config Config, videoReader io.ReadCloser) (*youtube.Video, error) {
 
 	if config.Filename == "" {
-		return fmt.Errorf("filename must be specified")
+		return nil, validationErrorf("filename must be specified")
 	}
 	if transport == nil {
-		return fmt.Errorf("transport cannot be nil")
+		return nil, validationErrorf("transport cannot be nil")
+	}
+	if config.AutoThumbnail < 0 || config.AutoThumbnail > 3 {
+		return nil, validationErrorf("autoThumbnail must be 1, 2 or 3")
+	}
+	if config.AutoThumbnail > 0 && config.Thumbnail != "" {
+		return nil, validationErrorf("autoThumbnail can't be used together with a thumbnail file")
+	}
+	if err := checkConflictPolicy(config.MetaOutConflict); err != nil {
+		return nil, validationErrorf("metaOutConflict: %w", err)
+	}
+	if config.MetaOutFields != "" && config.MetaOutFields != "full" && config.MetaOutFields != "minimal" {
+		return nil, validationErrorf("metaOutFields must be 'minimal' or 'full'")
+	}
+	if config.MetaOutIndent < 0 {
+		return nil, validationErrorf("metaOutIndent can't be negative")
+	}
+	if config.StdinFormat != "" {
+		if _, err := stdinContentType(config.StdinFormat); err != nil {
+			return nil, validationError(err)
+		}
+	}
+	chunksize, err := checkChunksize(config.Chunksize, config.StrictChunksize)
+	if err != nil {
+		return nil, validationError(err)
+	}
+	config.Chunksize = chunksize
+	if config.ContentOwner != "" && config.TargetChannel == "" {
+		return nil, validationErrorf("targetChannel must be specified when uploading on behalf of a content owner")
+	}
+	if config.OpenURL != "" && config.OpenURL != "watch" && config.OpenURL != "studio" {
+		return nil, validationErrorf("open must be 'watch' or 'studio'")
 	}
 	if videoReader == nil {
-		return fmt.Errorf("videoReader cannot be nil")
+		return nil, validationErrorf("videoReader cannot be nil")
 	}
 
-	var thumbReader io.ReadCloser
-	if config.Thumbnail != "" {
-		r, _, err := Open(config.Thumbnail, IMAGE)
+	// Regular files are checked against the state before uploading. Other sources can't be
+	// read twice, so their checksum is calculated during the upload and only recorded
+	var state *State
+	var checksum string
+	var hashReader *hashReadCloser
+	if config.StateFile != "" {
+		var err error
+		state, err = LoadState(config.StateFile)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		thumbReader = r
-		defer thumbReader.Close()
+		if isRegularFile(config.Filename) {
+			checksum, err = fileChecksum(config.Filename)
+			if err != nil {
+				return nil, err
+			}
+			if entry, ok := state.Lookup(stateKey(checksum, config.CacheFile)); ok {
+				fmt.Printf("File %q was already uploaded as video %s on %s. Skipping...\n",
+					config.Filename, entry.VideoID, entry.Uploaded.Format(time.DateTime))
+				return nil, nil
+			}
+		} else {
+			hashReader = newHashReadCloser(videoReader)
+			videoReader = hashReader
+		}
+	}
+
+	upload := &youtube.Video{}
+
+	videoMeta, err := LoadVideoMeta(config, upload)
+	if err != nil {
+		return nil, validationErrorf("error loading video meta data: %w", err)
+	}
+
+	// the video is only made public once processing has succeeded
+	playlistPrivacy := upload.Status.PrivacyStatus
+	if config.UploadThenPublic {
+		if upload.Status.PublishAt != "" {
+			return nil, validationErrorf("uploadThenPublic can't be used together with publishAt")
+		}
+		upload.Status.PrivacyStatus = "private"
+		playlistPrivacy = "public"
+	}
+
+	notify := config.NotifySubscribers
+	if config.NotifyAuto {
+		notify = notify && (playlistPrivacy == "public" || upload.Status.PublishAt != "")
+		config.Logger.Debugf("Notify subscribers: %t (privacy %q, publishAt %q)\n", notify, playlistPrivacy, upload.Status.PublishAt)
 	}
 
-	var captionReader io.ReadCloser
-	if config.Caption != "" {
-		r, _, err := Open(config.Caption, CAPTION)
+	// find missing thumbnail and caption files now, rather than after the video is uploaded
+	err = checkMedia(&config, videoMeta)
+	if err != nil {
+		return nil, validationError(err)
+	}
+
+	if config.AutoFirstFrame && config.Thumbnail == "" && config.AutoThumbnail == 0 {
+		thumbnail, cleanup, err := firstFrameThumbnail(config.Filename, config.TempFiles)
 		if err != nil {
-			return err
+			config.Logger.Debugf("Skipping first frame thumbnail: %s\n", err)
+		} else {
+			defer cleanup()
+			config.Thumbnail = thumbnail
+		}
+	}
+
+	// thumbnails, captions and images at URLs are fetched over the same transport as the API calls,
+	// without their authorization
+	mediaClient := &http.Client{Transport: transport}
+
+	var thumbReader io.ReadCloser
+	if config.Thumbnail != "" {
+		r, _, err := OpenWithClient(config.Thumbnail, IMAGE, mediaClient)
+		if err != nil {
+			return nil, err
 		}
-		captionReader = r
-		defer captionReader.Close()
+		thumbReader = r
+		defer thumbReader.Close()
 	}
 
 	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
@@ -75,32 +180,88 @@ func Run(ctx context.Context, transport *limiter.LimitTransport, config Config,
 
 	prog, err := progress.NewProgress(transport, progressInterval)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	prog.SetWidth(config.ProgressWidth)
+	// a failed write to the progress file stops the events that follow it, so the socket comes first
+	var events []io.Writer
+	if config.ProgressSocket != "" {
+		socket := progress.NewSocketWriter(config.ProgressSocket)
+		defer socket.Close()
+		events = append(events, socket)
+	}
+	if config.ProgressFile != "" {
+		file := progress.NewRotatingWriter(config.ProgressFile, config.ProgressFileMaxSize)
+		defer file.Close()
+		events = append(events, file)
+	}
+	if len(events) > 0 {
+		prog.SetEvents(io.MultiWriter(events...))
 	}
 
+	// progress stops when the upload returns
+	progCtx, progCancel := context.WithCancel(ctx)
+	defer progCancel()
+
 	signalChan := make(chan os.Signal, 1)
 	SetSignalNotify(signalChan)
-	go prog.Run(ctx, signalChan)
+	go prog.Run(progCtx, signalChan)
 
-	client, err := BuildOAuthHTTPClient(
-		ctx,
-		[]string{youtube.YoutubeUploadScope, youtube.YoutubepartnerScope, youtube.YoutubeScope},
-		config.OAuthPort,
-	)
+	service, err := newService(ctx, config)
 	if err != nil {
-		return fmt.Errorf("error building OAuth client: %w", err)
+		return nil, &kindError{kind: ErrAuth, err: err}
 	}
 
-	upload := &youtube.Video{}
+	// content owners can upload to any channel they manage, so there's nothing to check
+	if config.TargetChannel != "" && config.ContentOwner == "" {
+		err = checkTargetChannel(ctx, service, config.TargetChannel)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	videoMeta, err := LoadVideoMeta(config, upload)
-	if err != nil {
-		return fmt.Errorf("error loading video meta data: %w", err)
+	if config.InferCategory && upload.Snippet.CategoryId == "" {
+		categoryID, err := inferCategory(ctx, service, config.CacheFile)
+		if err != nil {
+			fmt.Printf("WARNING: unable to infer category, no category will be set: %s\n", err)
+		} else {
+			fmt.Printf("Using category %s, the most common category of recent uploads\n", categoryID)
+			upload.Snippet.CategoryId = categoryID
+		}
+	}
+	if config.RequireCategory && upload.Snippet.CategoryId == "" {
+		return nil, validationErrorf("the video has no category, and -requireCategory is set")
 	}
 
-	service, err := youtube.NewService(ctx, option.WithHTTPClient(client))
-	if err != nil {
-		return fmt.Errorf("error creating Youtube client: %w", err)
+	// stdin can't be used for the menu when the video is being piped in
+	if config.Interactive && config.Filename != "-" && utils.IsTerminal(os.Stdin) &&
+		len(videoMeta.PlaylistIDs) == 0 && len(videoMeta.PlaylistTitles) == 0 {
+		id, title, err := choosePlaylist(ctx, service, os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		if id != "" {
+			videoMeta.PlaylistIDs = append(videoMeta.PlaylistIDs, id)
+		}
+		if title != "" {
+			videoMeta.PlaylistTitles = append(videoMeta.PlaylistTitles, title)
+		}
+	}
+
+	if config.Confirm {
+		// stdin can't be used for the prompt when the video is being piped in
+		if config.Filename != "-" && utils.IsTerminal(os.Stdin) {
+			ok, err := confirmUpload(os.Stdin, config.Filename, upload, videoMeta)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				fmt.Printf("Upload cancelled\n")
+				return nil, nil
+			}
+		} else if !config.ConfirmNoTTY {
+			return nil, fmt.Errorf("can't ask for confirmation as stdin isn't a terminal. Use confirmNoTTY to upload anyway")
+		}
 	}
 
 	if config.Filename == "-" {
@@ -109,90 +270,420 @@ func Run(ctx context.Context, transport *limiter.LimitTransport, config Config,
 		fmt.Printf("Uploading file %q\n", config.Filename)
 	}
 
-	var option googleapi.MediaOption
 	var video *youtube.Video
 
-	option = googleapi.ChunkSize(config.Chunksize)
+	options := []googleapi.MediaOption{googleapi.ChunkSize(config.Chunksize)}
+	if config.PrintUploadID || config.UploadIDFile != "" {
+		transport.SetUploadIDHandler(func(id string) {
+			if config.PrintUploadID {
+				fmt.Printf("Upload ID: %s\n", id)
+			}
+			if config.UploadIDFile != "" {
+				err := os.WriteFile(config.UploadIDFile, []byte(id+"\n"), 0600)
+				if err != nil {
+					fmt.Printf("WARNING: error writing upload ID: %s\n", err)
+				}
+			}
+		})
+	}
+	if config.StdinFormat != "" {
+		// sniffing the content type is unreliable when the video can't be read twice
+		if isRegularFile(config.Filename) || strings.HasPrefix(config.Filename, "http") {
+			fmt.Printf("WARNING: stdinFormat only applies to videos read from stdin or a pipe. Ignoring it...\n")
+		} else {
+			contentType, _ := stdinContentType(config.StdinFormat)
+			config.Logger.Debugf("Uploading with content type %q\n", contentType)
+			options = append(options, googleapi.ContentType(contentType))
+		}
+	}
+	if config.MaxRetryDuration > 0 {
+		// a chunk is otherwise only retried for 32s, so the limit would rarely be reached
+		options = append(options, googleapi.ChunkRetryDeadline(config.MaxRetryDuration))
+		err = transport.SetMaxRetryDuration(config.MaxRetryDuration)
+		if err != nil {
+			return nil, validationError(err)
+		}
+	}
 
-	call := service.Videos.Insert([]string{"snippet", "status", "recordingDetails"}, upload)
+	parts := []string{"snippet", "status", "recordingDetails"}
+	if len(upload.Localizations) > 0 {
+		parts = append(parts, "localizations")
+	}
+	call := service.Videos.Insert(parts, upload)
 	if config.SendFileName && config.Filename != "-" {
 		filetitle := filepath.Base(config.Filename)
 		config.Logger.Debugf("Adding file name to request: %q\n", filetitle)
 		call.Header().Set("Slug", filetitle)
 	}
-	video, err = call.NotifySubscribers(config.NotifySubscribers).Media(videoReader, option).Do()
+	if config.ContentOwner != "" {
+		call = call.OnBehalfOfContentOwner(config.ContentOwner).OnBehalfOfContentOwnerChannel(config.TargetChannel)
+	}
+	var media io.Reader = videoReader
+	if config.ReadBufferSize > 0 {
+		// the rate limit is applied as the request is sent, after this buffer, so it isn't affected
+		media = bufio.NewReaderSize(videoReader, config.ReadBufferSize)
+	}
+	// only the video insert's requests are limited by the transport, not those of captions and images
+	video, err = call.NotifySubscribers(notify).Media(media, options...).Context(limiter.WithUpload(ctx)).Do()
 	if err != nil {
+		hint := forbiddenHint(err)
+		if hint == "" {
+			hint = invalidMetadataHint(err, upload.Snippet)
+		}
+		if hint != "" {
+			return nil, newUploadError(fmt.Errorf("error making YouTube API call: %w\n\n%s", err, hint))
+		}
 		if video != nil {
-			return fmt.Errorf("error making YouTube API call: %w, %v", err, video.HTTPStatusCode)
+			return nil, newUploadError(fmt.Errorf("error making YouTube API call: %w, %v", err, video.HTTPStatusCode))
 		} else {
-			return fmt.Errorf("error making YouTube API call: %w", err)
+			return nil, newUploadError(fmt.Errorf("error making YouTube API call: %w", err))
 		}
 	}
 	fmt.Printf("\nUpload successful! Video ID: %v\n", video.Id)
 
-	if config.MetaJSONOut != "" {
-		JSONOut, _ := json.Marshal(video)
-		err = os.WriteFile(config.MetaJSONOut, JSONOut, 0666)
+	if config.OpenURL != "" {
+		openVideo(video.Id, config.OpenURL)
+	}
+
+	if state != nil {
+		if hashReader != nil {
+			checksum = hashReader.Checksum()
+		}
+		err = state.Record(stateKey(checksum, config.CacheFile), StateEntry{
+			VideoID:  video.Id,
+			Filename: config.Filename,
+			Uploaded: time.Now(),
+		})
 		if err != nil {
-			return fmt.Errorf("error writing to video metadata file %q: %w", config.MetaJSONOut, err)
+			fmt.Printf("WARNING: %s\n", err)
 		}
-		fmt.Printf("Wrote video metadata to file %q\n", config.MetaJSONOut)
 	}
 
-	if thumbReader != nil {
-		fmt.Printf("Uploading thumbnail %q...\n", config.Thumbnail)
-		_, err = service.Thumbnails.Set(video.Id).Media(thumbReader).Do()
+	if config.FeedFile != "" {
+		title := upload.Snippet.Title
+		if video.Snippet != nil && video.Snippet.Title != "" {
+			title = video.Snippet.Title
+		}
+		err = addToFeed(config.FeedFile, video.Id, title, time.Now())
 		if err != nil {
-			return fmt.Errorf("error making YouTube API call: %w", err)
+			fmt.Printf("WARNING: %s\n", err)
 		}
 	}
 
-	// Insert caption
-	if captionReader != nil {
-		fmt.Printf("Uploading caption %q...\n", config.Caption)
-		captionObj := &youtube.Caption{
-			Snippet: &youtube.CaptionSnippet{},
-		}
-		captionObj.Snippet.VideoId = video.Id
-		captionObj.Snippet.Language = config.Language
-		captionObj.Snippet.Name = config.Language
-		captionInsert := service.Captions.Insert([]string{"snippet"}, captionObj).Sync(true)
-		captionRes, err := captionInsert.Media(captionReader).Do()
+	if config.MetaJSONOut != "" {
+		metaOut, err := resolveOutputPath(config.MetaJSONOut, config.MetaOutConflict)
 		if err != nil {
-			if captionRes != nil {
-				return fmt.Errorf("error inserting caption: %w, %v", err, captionRes.HTTPStatusCode)
-			} else {
-				return fmt.Errorf("error inserting caption: %w", err)
+			return video, fmt.Errorf("error writing to video metadata file: %w", err)
+		}
+		if metaOut != "" {
+			JSONOut, err := marshalMetaOut(video, config.MetaOutFields, config.MetaOutIndent)
+			if err != nil {
+				return video, fmt.Errorf("error encoding video metadata: %w", err)
+			}
+			err = os.WriteFile(metaOut, JSONOut, 0666)
+			if err != nil {
+				return video, fmt.Errorf("error writing to video metadata file %q: %w", metaOut, err)
 			}
+			fmt.Printf("Wrote video metadata to file %q\n", metaOut)
 		}
 	}
 
-	plx := &Playlistx{}
-	if upload.Status.PrivacyStatus != "" {
-		plx.PrivacyStatus = upload.Status.PrivacyStatus
-	}
+	// the remaining steps only depend on the video ID, so are run concurrently
+	var tasks []postUploadTask
 
-	if len(videoMeta.PlaylistIDs) > 0 {
-		plx.Title = ""
-		for _, pid := range videoMeta.PlaylistIDs {
-			plx.Id = pid
-			err = plx.AddVideoToPlaylist(service, video.Id)
+	if thumbReader != nil {
+		tasks = append(tasks, postUploadTask{"thumbnail", func() error {
+			fmt.Printf("Uploading thumbnail %q...\n", config.Thumbnail)
+			setResp, err := service.Thumbnails.Set(video.Id).Media(thumbReader).Context(ctx).Do()
+			if err == nil && config.VerifyThumbnail {
+				if verifyErr := verifyThumbnail(ctx, service, video.Id, setResp); verifyErr != nil {
+					fmt.Printf("WARNING: the thumbnail may not have been applied: %s. Check it in YouTube Studio\n", verifyErr)
+				}
+			}
 			if err != nil {
-				return fmt.Errorf("error adding video to playlist: %w", err)
+				if config.ThumbnailRequired && config.ThumbnailRollback {
+					fmt.Printf("Thumbnail upload failed. Setting video %s to private...\n", video.Id)
+					rbErr := setVideoPrivacy(ctx, service, video, "private")
+					if rbErr != nil {
+						return fmt.Errorf("error uploading thumbnail: %w (rollback also failed: %v)", err, rbErr)
+					}
+				}
+				return fmt.Errorf("error uploading thumbnail: %w", err)
 			}
-		}
+			return nil
+		}})
 	}
 
-	if len(videoMeta.PlaylistTitles) > 0 {
-		plx.Id = ""
-		for _, title := range videoMeta.PlaylistTitles {
-			plx.Title = title
-			err = plx.AddVideoToPlaylist(service, video.Id)
+	if config.AutoThumbnail > 0 {
+		tasks = append(tasks, postUploadTask{"autoThumbnail", func() error {
+			err := waitForProcessing(ctx, service, video.Id, config.ProcessingTimeout)
 			if err != nil {
-				return fmt.Errorf("error adding video to playlist: %w", err)
+				return err
+			}
+			fmt.Printf("Setting generated thumbnail %d as default...\n", config.AutoThumbnail)
+			return setAutoThumbnail(ctx, service, mediaClient, video.Id, config.AutoThumbnail)
+		}})
+	}
+
+	if len(videoMeta.Captions) > 0 {
+		tasks = append(tasks, postUploadTask{"captions", func() error {
+			return uploadCaptions(ctx, service, mediaClient, video.Id, videoMeta.Captions, config.CaptionConcurrency, config.CaptionReplace)
+		}})
+	}
+
+	if len(videoMeta.PlaylistIDs) > 0 || len(videoMeta.PlaylistTitles) > 0 {
+		tasks = append(tasks, postUploadTask{"playlists", func() error {
+			plx := &Playlistx{}
+			if playlistPrivacy != "" {
+				plx.PrivacyStatus = playlistPrivacy
+			}
+			plx.MadeForKids = upload.Status.SelfDeclaredMadeForKids
+			// new playlists are in the same language as the video
+			plx.DefaultLanguage = upload.Snippet.DefaultLanguage
+			plx.Thumbnail = config.PlaylistThumbnail
+			plx.Client = mediaClient
+
+			for _, pid := range videoMeta.PlaylistIDs {
+				plx.Id = pid
+				err := plx.AddVideoToPlaylistContext(ctx, service, video.Id)
+				if err != nil {
+					return fmt.Errorf("error adding video to playlist: %w", err)
+				}
+			}
+
+			plx.Id = ""
+			for _, title := range videoMeta.PlaylistTitles {
+				plx.Title = title
+				err := plx.AddVideoToPlaylistContext(ctx, service, video.Id)
+				if err != nil {
+					return fmt.Errorf("error adding video to playlist: %w", err)
+				}
 			}
+			return nil
+		}})
+	}
+
+	err = runTasks(config.Logger, tasks)
+	if err != nil {
+		return video, newUploadError(err)
+	}
+
+	if config.UploadThenPublic {
+		err = waitForProcessing(ctx, service, video.Id, config.ProcessingTimeout)
+		if err != nil {
+			return video, newUploadError(fmt.Errorf("video %s has been left private: %w", video.Id, err))
+		}
+		fmt.Printf("Processing complete. Setting video %s to public...\n", video.Id)
+		err = setVideoPrivacy(ctx, service, video, "public")
+		if err != nil {
+			return video, newUploadError(err)
 		}
 	}
 
+	return video, nil
+}
+
+// postUploadTask is a step that runs once the video has been uploaded
+type postUploadTask struct {
+	name string
+	run  func() error
+}
+
+// runTasks runs tasks concurrently, waiting for all of them to finish.
+// Errors from every failed task are returned
+func runTasks(logger utils.Logger, tasks []postUploadTask) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(tasks))
+	for i, task := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = task.run()
+			logger.Debugf("Task %q finished, error: %v\n", task.name, errs[i])
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// SetWatermark uploads config.Watermark as the channel branding watermark. No video is uploaded
+func SetWatermark(ctx context.Context, transport *limiter.LimitTransport, config Config) error {
+	if config.Watermark == "" {
+		return fmt.Errorf("watermark must be specified")
+	}
+	if transport == nil {
+		return fmt.Errorf("transport cannot be nil")
+	}
+
+	// check the image before going through authorization
+	data, contentType, err := readWatermark(config.Watermark, &http.Client{Transport: transport})
+	if err != nil {
+		return err
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+		Transport: transport,
+	})
+
+	service, err := newService(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Uploading watermark %q...\n", config.Watermark)
+	return setWatermark(service, data, contentType)
+}
+
+// ListChannels prints the channels that videos can be uploaded to, for use with config.TargetChannel
+func ListChannels(ctx context.Context, transport *limiter.LimitTransport, config Config) error {
+	if transport == nil {
+		return fmt.Errorf("transport cannot be nil")
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+		Transport: transport,
+	})
+
+	service, err := newService(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	channels, err := listChannels(ctx, service, config.ContentOwner)
+	if err != nil {
+		return err
+	}
+	for _, c := range channels {
+		fmt.Printf("%s\t%s\n", c.Id, c.Snippet.Title)
+	}
 	return nil
 }
+
+// Describe prints the current metadata of the existing video config.VideoID, either as
+// a human readable summary or, if config.DescribeFormat is "json", as JSON. If config.ExportMeta
+// is set, the metadata is also written there in metaJSON format. No video is uploaded
+func Describe(ctx context.Context, transport *limiter.LimitTransport, config Config) error {
+	if config.VideoID == "" {
+		return fmt.Errorf("videoID must be specified")
+	}
+	if config.DescribeFormat != "" && config.DescribeFormat != "human" && config.DescribeFormat != "json" {
+		return fmt.Errorf("describe format must be 'human' or 'json'")
+	}
+	if transport == nil {
+		return fmt.Errorf("transport cannot be nil")
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+		Transport: transport,
+	})
+
+	service, err := newService(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	video, err := getVideo(service, config.VideoID)
+	if err != nil {
+		return err
+	}
+
+	switch config.DescribeFormat {
+	case "json":
+		JSONOut, err := json.MarshalIndent(video, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", JSONOut)
+	case "human":
+		printVideo(os.Stdout, video)
+	}
+
+	if config.ExportMeta != "" {
+		JSONOut, err := json.MarshalIndent(videoToMeta(video), "", "  ")
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(config.ExportMeta, JSONOut, 0666)
+		if err != nil {
+			return fmt.Errorf("error writing metadata file %q: %w", config.ExportMeta, err)
+		}
+		fmt.Printf("Wrote metadata of video %s to file %q\n", video.Id, config.ExportMeta)
+	}
+
+	return nil
+}
+
+// uploadScopes are the OAuth scopes that youtubeuploader asks for
+var uploadScopes = []string{youtube.YoutubeUploadScope, youtube.YoutubepartnerScope, youtube.YoutubeScope}
+
+// scopePrefix is the common prefix of Google API scopes
+const scopePrefix = "https://www.googleapis.com/auth/"
+
+// newService returns an authorized YouTube client. The HTTP client used for
+// requests is taken from ctx
+func newService(ctx context.Context, config Config) (*youtube.Service, error) {
+	client := config.HTTPClient
+	if client == nil {
+		scopes := uploadScopes
+		if len(config.Scopes) > 0 {
+			if !slices.Contains(config.Scopes, youtube.YoutubeUploadScope) {
+				return nil, validationErrorf("scopes must include %s", youtube.YoutubeUploadScope)
+			}
+			scopes = config.Scopes
+		}
+
+		var err error
+		client, err = buildOAuthHTTPClient(
+			ctx,
+			scopes,
+			config.OAuthPort,
+			config.CacheFile,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error building OAuth client: %w", err)
+		}
+	}
+
+	opts := []option.ClientOption{option.WithHTTPClient(client)}
+	if config.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(config.Endpoint))
+	}
+	service, err := youtube.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Youtube client: %w", err)
+	}
+
+	return service, nil
+}
+
+// videoMetaOut is the "minimal" MetaJSONOut format. Fields are written in the order they're declared
+type videoMetaOut struct {
+	Id string `json:"id"`
+	*VideoMeta
+
+	// these replace the VideoMeta fields, so that dates that aren't set are left out
+	PublishAt     *Date `json:"publishAt,omitempty"`
+	RecordingDate *Date `json:"recordingDate,omitempty"`
+}
+
+// marshalMetaOut encodes the uploaded video for MetaJSONOut, with the fields and indentation described
+// by Config.MetaOutFields and Config.MetaOutIndent
+func marshalMetaOut(video *youtube.Video, fields string, indent int) ([]byte, error) {
+	var v any = video
+	if fields == "minimal" {
+		vm := videoToMeta(video)
+		out := videoMetaOut{Id: video.Id, VideoMeta: vm}
+		if !vm.PublishAt.IsZero() {
+			out.PublishAt = &vm.PublishAt
+		}
+		if !vm.RecordingDate.IsZero() {
+			out.RecordingDate = &vm.RecordingDate
+		}
+		v = out
+	}
+	if indent > 0 {
+		return json.MarshalIndent(v, "", strings.Repeat(" ", indent))
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,217 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package youtubeuploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State records the source files that have been uploaded, keyed by the SHA-256 checksum
+// of their contents. It's used to avoid uploading the same file twice
+type State struct {
+	mu       sync.Mutex
+	filename string
+
+	Uploads map[string]StateEntry `json:"uploads"`
+}
+
+type StateEntry struct {
+	VideoID  string    `json:"videoId"`
+	Filename string    `json:"filename"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// LoadState reads the state file. A missing file gives an empty state
+func LoadState(filename string) (*State, error) {
+	s := &State{
+		filename: filename,
+		Uploads:  make(map[string]StateEntry),
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("error reading state file %q: %w", filename, err)
+	}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing state file %q: %w", filename, err)
+	}
+	if s.Uploads == nil {
+		s.Uploads = make(map[string]StateEntry)
+	}
+
+	return s, nil
+}
+
+// Lookup returns the upload recorded for checksum
+func (s *State) Lookup(checksum string) (StateEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.Uploads[checksum]
+	return entry, ok
+}
+
+// Record adds an upload to the state and saves it
+func (s *State) Record(checksum string, entry StateEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Uploads[checksum] = entry
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(s.filename, data)
+	if err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file first, then renames it to filename,
+// so an interrupted write doesn't lose the existing contents
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// stateKey returns the key that an upload of a file with checksum to the channel
+// authorized by cacheFile is stored under. Uploads using the default token are keyed
+// by checksum alone
+func stateKey(checksum, cacheFile string) string {
+	if cacheFile == "" {
+		return checksum
+	}
+	return checksum + ":" + cacheFile
+}
+
+// fileChecksum returns the hex encoded SHA-256 checksum of the file's contents
+func fileChecksum(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("error calculating checksum of %q: %w", filename, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashReadCloser calculates the checksum of the data as it's read
+type hashReadCloser struct {
+	io.ReadCloser
+	hash hash.Hash
+}
+
+func newHashReadCloser(r io.ReadCloser) *hashReadCloser {
+	return &hashReadCloser{ReadCloser: r, hash: sha256.New()}
+}
+
+func (h *hashReadCloser) Read(p []byte) (int, error) {
+	n, err := h.ReadCloser.Read(p)
+	h.hash.Write(p[:n])
+	return n, err
+}
+
+// Checksum returns the hex encoded SHA-256 checksum of the data read so far
+func (h *hashReadCloser) Checksum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+// UploadedList is a text file listing the uploaded files, one per line. It's a lighter
+// alternative to State, as the files don't have to be read to calculate their checksum.
+// Local files are listed by their absolute path
+type UploadedList string
+
+// Contains reports whether filename is in the list. A missing list is empty
+func (l UploadedList) Contains(filename string) (bool, error) {
+	data, err := os.ReadFile(string(l))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error reading uploaded list %q: %w", string(l), err)
+	}
+	name := listName(filename)
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimRight(line, "\r") == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Add appends filename to the list
+func (l UploadedList) Add(filename string) error {
+	file, err := os.OpenFile(string(l), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening uploaded list %q: %w", string(l), err)
+	}
+	_, err = fmt.Fprintln(file, listName(filename))
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error writing uploaded list %q: %w", string(l), err)
+	}
+	return file.Close()
+}
+
+// listName is the name filename is listed under in an UploadedList
+func listName(filename string) string {
+	if filename == "-" || strings.HasPrefix(filename, "http") {
+		return filename
+	}
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filename
+}
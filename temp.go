@@ -0,0 +1,103 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package youtubeuploader
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+)
+
+// TempFiles creates the temporary directories used while uploading, for preprocessed videos, split
+// parts and extracted thumbnails, and removes them afterwards. A nil *TempFiles uses the OS default
+// directory and always removes them
+type TempFiles struct {
+	// Dir is where the temporary directories are created. Empty means the OS default
+	Dir string
+	// Keep leaves the directories in place for debugging, instead of removing them
+	Keep bool
+
+	mu   sync.Mutex
+	dirs []string
+}
+
+// root returns the directory that temporary directories are created in
+func (t *TempFiles) root() string {
+	if t == nil || t.Dir == "" {
+		return os.TempDir()
+	}
+	return t.Dir
+}
+
+// MkdirTemp creates a temporary directory, returning it along with a function that removes it
+func (t *TempFiles) MkdirTemp() (string, func(), error) {
+	if t == nil {
+		dir, err := os.MkdirTemp("", "youtubeuploader-")
+		if err != nil {
+			return "", nil, err
+		}
+		return dir, func() { os.RemoveAll(dir) }, nil
+	}
+
+	if t.Dir != "" {
+		err := os.MkdirAll(t.Dir, 0755)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	dir, err := os.MkdirTemp(t.Dir, "youtubeuploader-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	t.mu.Lock()
+	t.dirs = append(t.dirs, dir)
+	t.mu.Unlock()
+
+	return dir, func() { t.remove(dir) }, nil
+}
+
+// RemoveAll removes the temporary directories that haven't been removed yet, e.g. when exiting on an error
+func (t *TempFiles) RemoveAll() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	dirs := slices.Clone(t.dirs)
+	t.mu.Unlock()
+
+	for _, dir := range dirs {
+		t.remove(dir)
+	}
+}
+
+// remove removes dir, unless the temporary files are being kept
+func (t *TempFiles) remove(dir string) {
+	t.mu.Lock()
+	i := slices.Index(t.dirs, dir)
+	if i < 0 {
+		t.mu.Unlock()
+		return
+	}
+	t.dirs = slices.Delete(t.dirs, i, i+1)
+	t.mu.Unlock()
+
+	if t.Keep {
+		fmt.Printf("Keeping temporary files in %q\n", dir)
+		return
+	}
+	os.RemoveAll(dir)
+}
@@ -15,10 +15,14 @@ limitations under the License.
 package test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"log/slog"
 	"mime"
@@ -27,13 +31,20 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	yt "github.com/porjo/youtubeuploader"
 	"github.com/porjo/youtubeuploader/internal/limiter"
+	"github.com/porjo/youtubeuploader/internal/progress"
 	"github.com/porjo/youtubeuploader/internal/utils"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/youtube/v3"
 )
 
@@ -57,6 +68,36 @@ var (
 	recordingDate yt.Date
 
 	logger *slog.Logger
+
+	// captionRequests counts caption inserts. When captionFailures is above zero,
+	// that many inserts fail with a server error before one succeeds
+	captionRequests atomic.Int32
+	captionFailures atomic.Int32
+
+	// captionUpdates counts caption updates. The mock video has an English caption track that can be
+	// updated, and a French one generated by speech recognition
+	captionUpdates atomic.Int32
+
+	// captionBodies holds the body of each caption insert or update
+	captionBodies   []string
+	captionBodiesMu sync.Mutex
+
+	// videoForbiddenReason, when set, makes video inserts fail with a 403 error with that reason
+	videoForbiddenReason atomic.Value
+
+	// videoInvalidReason, when set, makes video inserts fail with a 400 error with that reason,
+	// located at the field in videoInvalidLocation
+	videoInvalidReason   atomic.Value
+	videoInvalidLocation atomic.Value
+
+	// playlistImageRequests counts playlist thumbnail uploads
+	playlistImageRequests atomic.Int32
+
+	// mediaContentType is the content type of the video in the last video insert
+	mediaContentType atomic.Value
+
+	// notifyParam is the notifySubscribers parameter of the last video insert
+	notifyParam atomic.Value
 )
 
 type mockTransport struct {
@@ -100,6 +141,40 @@ func TestMain(m *testing.M) {
 
 		l := logger.With("src", "httptest")
 
+		if strings.HasPrefix(r.URL.Path, "/upload/youtube/v3/captions") {
+			handleCaptionPost(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/upload/youtube/v3/playlistImages") {
+			playlistImageRequests.Add(1)
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, `{"id": "image"}`)
+			return
+		}
+
+		if query := r.URL.Query(); strings.HasPrefix(r.URL.Path, "/upload/youtube/v3/videos") && query.Has("notifySubscribers") {
+			notifyParam.Store(query.Get("notifySubscribers"))
+		}
+
+		if reason, _ := videoForbiddenReason.Load().(string); reason != "" && strings.HasPrefix(r.URL.Path, "/upload/youtube/v3/videos") {
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"error": {"code": 403, "message": "forbidden", "errors": [{"reason": %q, "message": "forbidden"}]}}`, reason)
+			return
+		}
+
+		if reason, _ := videoInvalidReason.Load().(string); reason != "" && strings.HasPrefix(r.URL.Path, "/upload/youtube/v3/videos") {
+			location, _ := videoInvalidLocation.Load().(string)
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": {"code": 400, "message": "invalid", "errors": [{"reason": %q, "message": "The request metadata is invalid.", "locationType": "other", "location": %q}]}}`, reason, location)
+			return
+		}
+
 		video, err := handleVideoPost(r, l)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -119,9 +194,14 @@ func TestMain(m *testing.M) {
 		switch r.Host {
 		case "oauth2.googleapis.com":
 			fmt.Fprintln(w, oAuthResponse)
-		case "youtube.googleapis.com":
+		default:
 
 			if strings.HasPrefix(r.URL.RequestURI(), "/upload") {
+				if query := r.URL.Query(); query.Get("uploadType") == "resumable" && !query.Has("upload_id") {
+					// start a resumable upload session
+					w.Header().Set("Location", testServer.URL+r.URL.Path+"?uploadType=resumable&upload_id=session")
+					return
+				}
 				video := youtube.Video{
 					Id: "test",
 				}
@@ -131,6 +211,21 @@ func TestMain(m *testing.M) {
 					return
 				}
 				fmt.Fprintln(w, string(videoJ))
+			} else if strings.HasPrefix(r.URL.RequestURI(), "/youtube/v3/playlists") && r.Method == http.MethodPost {
+				// a new playlist is returned as it was sent, with an ID
+				var playlist youtube.Playlist
+				err := json.NewDecoder(r.Body).Decode(&playlist)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				playlist.Id = "zzzz"
+				playlistJ, err := json.Marshal(playlist)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				fmt.Fprintln(w, string(playlistJ))
 			} else if strings.HasPrefix(r.URL.RequestURI(), "/youtube/v3/playlists") {
 				playlist1 := &youtube.Playlist{
 					Id: "xxxx",
@@ -153,6 +248,8 @@ func TestMain(m *testing.M) {
 					return
 				}
 				fmt.Fprintln(w, string(playlistJ))
+			} else if strings.HasPrefix(r.URL.RequestURI(), "/youtube/v3/captions") {
+				fmt.Fprintln(w, `{"items": [{"id": "en-track", "snippet": {"language": "en", "trackKind": "standard"}}, {"id": "fr-asr", "snippet": {"language": "fr", "trackKind": "asr"}}]}`)
 			} else if strings.HasPrefix(r.URL.RequestURI(), "/youtube/v3/playlistItems") {
 				fmt.Fprintln(w, "{}")
 			}
@@ -217,6 +314,366 @@ func TestRateLimit(t *testing.T) {
 
 }
 
+func TestReadBufferRateLimit(t *testing.T) {
+
+	runTimeWant := 2
+
+	rateLimit := int(fileSize / 125 / runTimeWant)
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, fileSize, rateLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the buffer is larger than the whole video, so the source is read all at once
+	bufferConfig := config
+	bufferConfig.ReadBufferSize = fileSize * 2
+
+	start := time.Now()
+	err = yt.Run(context.Background(), transport, bufferConfig, &mockReader{fileSize: fileSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runTimeGot := time.Since(start)
+	startLimit := time.Duration(runTimeWant*1000-100) * time.Millisecond
+	endLimit := time.Duration(runTimeWant*1000+100) * time.Millisecond
+	if runTimeGot < startLimit || runTimeGot > endLimit {
+		t.Fatalf("run time took longer/shorter than expected with a read buffer: %s", runTimeGot)
+	}
+}
+
+func TestSetRateLimit(t *testing.T) {
+
+	// slow enough that the upload would take 20 seconds without the change
+	slowRate := int(fileSize / 125 / 20)
+	fastRate := int(fileSize / 125)
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, fileSize, slowRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		err := transport.SetRateLimit(fastRate)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	start := time.Now()
+	err = yt.Run(context.Background(), transport, config, &mockReader{fileSize: fileSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runTimeGot := time.Since(start)
+	t.Logf("run time: %s\n", runTimeGot)
+
+	// 500ms at the slow rate, then about 1s for the rest at the fast rate
+	if runTimeGot < time.Second || runTimeGot > 3*time.Second {
+		t.Fatalf("rate limit change didn't take effect, run time: %s", runTimeGot)
+	}
+}
+
+func TestRateSmoothing(t *testing.T) {
+
+	// 5MB/s for the first 1.2 seconds, then 1MB/s
+	fastRate := int(fileSize / 125 / 2)
+	slowRate := int(fileSize / 125 / 10)
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, fileSize, fastRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transport.SetRateSmoothing(0.8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var status limiter.Status
+	go func() {
+		time.Sleep(1200 * time.Millisecond)
+		err := transport.SetRateLimit(slowRate)
+		if err != nil {
+			t.Error(err)
+		}
+		time.Sleep(2 * time.Second)
+		status = transport.GetMonitorStatus()
+		cancel()
+	}()
+
+	_ = yt.Run(ctx, transport, config, &mockReader{fileSize: fileSize})
+	<-ctx.Done()
+
+	t.Logf("average rate %d B/s, smoothed rate %d B/s", status.AvgRate, status.SmoothRate)
+
+	// the smoothed rate should have mostly caught up with the slow rate, unlike the average
+	if status.SmoothRate == 0 || status.SmoothRate >= status.AvgRate {
+		t.Fatalf("smoothed rate %d B/s didn't follow the slowdown (average %d B/s)", status.SmoothRate, status.AvgRate)
+	}
+}
+
+func TestCaptionRetry(t *testing.T) {
+
+	captionFile := filepath.Join(t.TempDir(), "test.srt")
+	err := os.WriteFile(captionFile, []byte("1\n00:00:00,000 --> 00:00:01,000\ntest\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captionConfig := config
+	captionConfig.PlaylistIDs = nil
+	captionConfig.Caption = captionFile
+
+	captionRequests.Store(0)
+	captionFailures.Store(1)
+	defer captionFailures.Store(0)
+
+	err = yt.Run(context.Background(), transport, captionConfig, &mockReader{fileSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := captionRequests.Load(); got != 2 {
+		t.Fatalf("expected 2 caption requests, got %d", got)
+	}
+}
+
+func TestExchangeTokenRetry(t *testing.T) {
+
+	var requests atomic.Int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, oAuthResponse)
+	}))
+	defer tokenServer.Close()
+
+	oauthConfig := &oauth2.Config{
+		ClientID: "test",
+		Endpoint: oauth2.Endpoint{TokenURL: tokenServer.URL, AuthStyle: oauth2.AuthStyleInParams},
+	}
+	token, err := yt.ExchangeToken(context.Background(), oauthConfig, "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken == "" {
+		t.Fatal("expected an access token")
+	}
+	if got := requests.Load(); got != 2 {
+		t.Fatalf("expected 2 token requests, got %d", got)
+	}
+}
+
+func TestExchangeTokenInvalidGrant(t *testing.T) {
+
+	var requests atomic.Int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, `{"error": "invalid_grant"}`)
+	}))
+	defer tokenServer.Close()
+
+	oauthConfig := &oauth2.Config{
+		ClientID: "test",
+		Endpoint: oauth2.Endpoint{TokenURL: tokenServer.URL, AuthStyle: oauth2.AuthStyleInParams},
+	}
+	_, err := yt.ExchangeToken(context.Background(), oauthConfig, "code")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("invalid_grant shouldn't be retried, got %d token requests", got)
+	}
+}
+
+func TestForbiddenHints(t *testing.T) {
+
+	hints := map[string]string{
+		"youtubeSignupRequired": "doesn't have a YouTube channel",
+		"forbidden":             "isn't allowed to upload",
+		"uploadLimitExceeded":   "limit on the number of videos",
+	}
+
+	defer videoForbiddenReason.Store("")
+
+	for reason, want := range hints {
+		t.Run(reason, func(t *testing.T) {
+			transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			videoForbiddenReason.Store(reason)
+			err = yt.Run(context.Background(), transport, config, &mockReader{fileSize: 1000})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), want) {
+				t.Fatalf("expected error to contain %q, got %q", want, err)
+			}
+		})
+	}
+}
+
+func TestInvalidMetadataHints(t *testing.T) {
+
+	tests := []struct {
+		reason   string
+		location string
+		want     string
+	}{
+		{"invalidTitle", "body.snippet.title", "rejected the title \"test video\" (10 characters)"},
+		{"invalidDescription", "body.snippet.description", "rejected the description (16 bytes)"},
+		{"invalidTags", "body.snippet.tags", "rejected the snippet.tags field"},
+	}
+
+	defer videoInvalidReason.Store("")
+
+	for _, test := range tests {
+		t.Run(test.reason, func(t *testing.T) {
+			transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			invalidConfig := config
+			invalidConfig.Title = "test video"
+			invalidConfig.Description = "test description"
+			videoInvalidReason.Store(test.reason)
+			videoInvalidLocation.Store(test.location)
+			err = yt.Run(context.Background(), transport, invalidConfig, &mockReader{fileSize: 1000})
+			if !errors.Is(err, yt.ErrValidation) {
+				t.Fatalf("expected a validation error, got %v", err)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("expected error to contain %q, got %q", test.want, err)
+			}
+		})
+	}
+}
+
+func TestRunHook(t *testing.T) {
+
+	dir := t.TempDir()
+
+	err := yt.RunHook("touch "+filepath.Join(dir, "{videoId}"), "{videoId}", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test")); err != nil {
+		t.Fatalf("hook wasn't run with the video ID: %s", err)
+	}
+
+	// a value containing a placeholder isn't expanded again
+	err = yt.RunHook("touch "+filepath.Join(dir, "{error}"), "{error}", "bad {filename}", "{filename}", "video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad {filename}")); err != nil {
+		t.Fatalf("expected the error to be substituted as it is: %s", err)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+
+	// no token or host rewriting is needed when the test server is the endpoint
+	transport, err := yt.NewLimitTransport(http.DefaultTransport, 1000, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpointConfig := config
+	endpointConfig.HTTPClient = &http.Client{Transport: transport}
+	endpointConfig.Endpoint = testServer.URL + "/"
+
+	video, err := yt.Upload(context.Background(), transport, endpointConfig, &mockReader{fileSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Id != "test" {
+		t.Fatalf("expected video ID %q, got %q", "test", video.Id)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, fileSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transport.SetIdleTimeout(300 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the video stops being read part way through, until the test is over
+	unblock := make(chan struct{})
+	go func() {
+		time.Sleep(2 * time.Second)
+		close(unblock)
+	}()
+	reader := &stallReader{mockReader: mockReader{fileSize: fileSize}, stallAt: fileSize / 2, unblock: unblock}
+
+	err = yt.Run(context.Background(), transport, config, reader)
+	if !errors.Is(err, limiter.ErrIdle) {
+		t.Fatalf("expected an idle error, got %v", err)
+	}
+}
+
+// stallReader blocks once stallAt bytes have been read, until unblock is closed
+type stallReader struct {
+	mockReader
+	stallAt int
+	unblock chan struct{}
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	if s.read >= s.stallAt {
+		<-s.unblock
+	}
+	return s.mockReader.Read(p)
+}
+
+func handleCaptionPost(w http.ResponseWriter, r *http.Request) {
+	captionRequests.Add(1)
+	if r.Method == http.MethodPut {
+		captionUpdates.Add(1)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	captionBodiesMu.Lock()
+	captionBodies = append(captionBodies, string(body))
+	captionBodiesMu.Unlock()
+
+	if captionFailures.Load() > 0 {
+		captionFailures.Add(-1)
+		http.Error(w, "caption processing failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, `{"id": "caption"}`)
+}
+
 func handleVideoPost(r *http.Request, l *slog.Logger) (*youtube.Video, error) {
 
 	if r.Method != http.MethodPost {
@@ -261,6 +718,9 @@ func handleVideoPost(r *http.Request, l *slog.Logger) (*youtube.Video, error) {
 		}
 
 		contentType := part.Header.Get("Content-Type")
+		if contentType != "application/json" {
+			mediaContentType.Store(contentType)
+		}
 		switch contentType {
 		case "application/json":
 			// Parse JSON part
@@ -281,3 +741,1223 @@ func handleVideoPost(r *http.Request, l *slog.Logger) (*youtube.Video, error) {
 
 	return video, nil
 }
+
+func TestManifest(t *testing.T) {
+
+	dir := t.TempDir()
+
+	manifestFile := filepath.Join(dir, "manifest.json")
+	manifestJSON := `{"videos": [
+		{"filename": "one.mp4", "thumbnail": "one.jpg", "title": "One", "playlistTitles": ["Entry Playlist"]},
+		{"filename": "two.mp4"}
+	]}`
+	err := os.WriteFile(manifestFile, []byte(manifestJSON), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := yt.LoadManifest(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Videos) != 2 {
+		t.Fatalf("expected 2 videos, got %d", len(manifest.Videos))
+	}
+	entry := manifest.Videos[0]
+	if entry.Filename != "one.mp4" || entry.Thumbnail != "one.jpg" || entry.Title != "One" {
+		t.Fatalf("unexpected manifest entry %+v", entry)
+	}
+
+	// the entry's metadata overrides -metaJSON, except playlists which are combined
+	metaFile := filepath.Join(dir, "meta.json")
+	err = os.WriteFile(metaFile, []byte(`{"title": "Meta", "description": "Meta description", "playlistTitles": ["Meta Playlist"]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestConfig := config
+	manifestConfig.MetaJSON = []string{metaFile}
+	manifestConfig.Meta = entry.Meta
+	video := &youtube.Video{}
+	videoMeta, err := yt.LoadVideoMeta(manifestConfig, video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Snippet.Title != "One" || video.Snippet.Description != "Meta description" {
+		t.Fatalf("unexpected title %q and description %q", video.Snippet.Title, video.Snippet.Description)
+	}
+	if !slices.Equal(videoMeta.PlaylistTitles, []string{"Meta Playlist", "Entry Playlist"}) {
+		t.Fatalf("unexpected playlists %v", videoMeta.PlaylistTitles)
+	}
+
+	err = os.WriteFile(manifestFile, []byte(`{"videos": [{"title": "No filename"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = yt.LoadManifest(manifestFile)
+	if err == nil {
+		t.Fatal("expected an error for an entry without a filename")
+	}
+}
+
+func TestUploadWindow(t *testing.T) {
+
+	now := time.Now()
+	between := now.Add(2*time.Hour).Format("15:04") + "-" + now.Add(3*time.Hour).Format("15:04")
+	window, err := limiter.ParseLimitBetween(between, "15:04")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.SetUploadWindow(window)
+
+	// the window isn't open, so the upload waits until it's cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err = yt.Run(ctx, transport, config, &mockReader{fileSize: 1000})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the upload to wait for the window, got %v", err)
+	}
+	if transport.HasStarted() {
+		t.Fatal("upload started outside the window")
+	}
+}
+
+func TestFeed(t *testing.T) {
+
+	feedConfig := config
+	feedConfig.FeedFile = filepath.Join(t.TempDir(), "feed.xml")
+
+	for _, title := range []string{"First", "Second"} {
+		transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		feedConfig.Title = title
+		_, err = yt.Upload(context.Background(), transport, feedConfig, &mockReader{fileSize: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(feedConfig.FeedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feed struct {
+		Entries []struct {
+			Title string `xml:"title"`
+			Link  struct {
+				Href string `xml:"href,attr"`
+			} `xml:"link"`
+		} `xml:"entry"`
+	}
+	err = xml.Unmarshal(data, &feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Entries) != 2 {
+		t.Fatalf("expected 2 feed entries, got %d", len(feed.Entries))
+	}
+	if feed.Entries[0].Title != "Second" || feed.Entries[1].Title != "First" {
+		t.Fatalf("expected the newest upload first, got %q, %q", feed.Entries[0].Title, feed.Entries[1].Title)
+	}
+	if feed.Entries[0].Link.Href != "https://www.youtube.com/watch?v=test" {
+		t.Fatalf("unexpected link %q", feed.Entries[0].Link.Href)
+	}
+}
+
+func TestValidateLanguage(t *testing.T) {
+
+	langConfig := config
+	langConfig.ValidateLanguage = true
+	langConfig.Language = "EN-us"
+
+	video := &youtube.Video{}
+	_, err := yt.LoadVideoMeta(langConfig, video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Snippet.DefaultLanguage != "en-US" || video.Snippet.DefaultAudioLanguage != "en-US" {
+		t.Fatalf("expected the language to be normalized to %q, got %q", "en-US", video.Snippet.DefaultLanguage)
+	}
+
+	langConfig.Language = "english"
+	_, err = yt.LoadVideoMeta(langConfig, &youtube.Video{})
+	if err == nil {
+		t.Fatal("expected an error for an invalid language code")
+	}
+}
+
+func TestMetaLimitsDebug(t *testing.T) {
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	debugConfig := config
+	debugConfig.Logger = utils.NewLogger(true)
+	debugConfig.Title = "Holiday"
+	debugConfig.Description = "Day one"
+	debugConfig.Tags = "beach,summer holiday"
+
+	_, err := yt.LoadVideoMeta(debugConfig, &youtube.Video{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Title: 7 of 100 characters", "Description: 7 of 5000 bytes", "Tags: 2 tags, 22 of 500 characters in total"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected debug output to contain %q, got %q", want, buf.String())
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"8388608", 8388608},
+		{"256KB", 256 * 1024},
+		{"8MB", 8 << 20},
+		{"16MiB", 16 << 20},
+		{"1g", 1 << 30},
+		{"512 B", 512},
+	}
+	for _, test := range tests {
+		got, err := utils.ParseSize(test.in)
+		if err != nil {
+			t.Fatalf("%q: %s", test.in, err)
+		}
+		if got != test.want {
+			t.Fatalf("%q: expected %d, got %d", test.in, test.want, got)
+		}
+	}
+
+	for _, in := range []string{"", "MB", "-1MB", "8TB", "1.5MB"} {
+		if _, err := utils.ParseSize(in); err == nil {
+			t.Fatalf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestChunksize(t *testing.T) {
+
+	chunkConfig := config
+	chunkConfig.Chunksize = 4096
+	chunkConfig.StrictChunksize = true
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = yt.Upload(context.Background(), transport, chunkConfig, &mockReader{fileSize: 1000})
+	if err == nil {
+		t.Fatal("expected an error for a chunksize that isn't a multiple of 256KB")
+	}
+
+	// without -strictChunksize, it's rounded to 256KB
+	chunkConfig.StrictChunksize = false
+	_, err = yt.Upload(context.Background(), transport, chunkConfig, &mockReader{fileSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadIDFile(t *testing.T) {
+
+	idConfig := config
+	idConfig.Chunksize = 256 * 1024
+	idConfig.UploadIDFile = filepath.Join(t.TempDir(), "uploadid")
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1024*1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = yt.Upload(context.Background(), transport, idConfig, &mockReader{fileSize: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := transport.UploadID(); id != "session" {
+		t.Fatalf("expected upload ID 'session', got %q", id)
+	}
+	b, err := os.ReadFile(idConfig.UploadIDFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "session\n" {
+		t.Fatalf("unexpected upload ID file contents %q", b)
+	}
+}
+
+func TestPreprocessFreeSpace(t *testing.T) {
+
+	input := filepath.Join(t.TempDir(), "video.mp4")
+	err := os.WriteFile(input, make([]byte, 1000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = yt.Preprocess("cp {input} {output}", input, 1<<62, nil)
+	if err == nil || !strings.Contains(err.Error(), "not enough free space") {
+		t.Fatalf("expected a free space error, got %v", err)
+	}
+
+	output, cleanup, err := yt.Preprocess("cp {input} {output}", input, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if _, err := os.Stat(output); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTempFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "video.mp4")
+	err := os.WriteFile(input, make([]byte, 1000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the temporary directory is created if need be
+	temp := &yt.TempFiles{Dir: filepath.Join(dir, "tmp")}
+	output, cleanup, err := yt.Preprocess("cp {input} {output}", input, 0, temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(output, temp.Dir+string(filepath.Separator)) {
+		t.Fatalf("expected %q to be in %q", output, temp.Dir)
+	}
+	cleanup()
+	if _, err := os.Stat(output); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected %q to have been removed", output)
+	}
+
+	// files left behind, e.g. by a failed upload, are removed by RemoveAll
+	output, _, err = yt.Preprocess("cp {input} {output}", input, 0, temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp.RemoveAll()
+	if _, err := os.Stat(output); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected %q to have been removed", output)
+	}
+
+	temp.Keep = true
+	output, cleanup, err = yt.Preprocess("cp {input} {output}", input, 0, temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	temp.RemoveAll()
+	if _, err := os.Stat(output); err != nil {
+		t.Fatalf("expected %q to be kept: %s", output, err)
+	}
+}
+
+func TestMoveAfterUpload(t *testing.T) {
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "video.mp4")
+	done := filepath.Join(dir, "done")
+
+	for _, want := range []string{"video.mp4", "video.1.mp4"} {
+		err := os.WriteFile(filename, make([]byte, 1000), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		moved, err := yt.MoveFile(filename, done)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if moved != filepath.Join(done, want) {
+			t.Fatalf("expected the video to be moved to %q, got %q", want, moved)
+		}
+		if _, err := os.Stat(moved); err != nil {
+			t.Fatalf("expected the video to be moved to %q: %s", want, err)
+		}
+		if _, err := os.Stat(filename); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("expected %q to have been moved", filename)
+		}
+	}
+}
+
+func TestOpenURL(t *testing.T) {
+
+	content := bytes.Repeat([]byte("video"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	source, err := yt.CheckSource(server.URL + "/video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.Size != int64(len(content)) || !source.IsVideo() {
+		t.Fatalf("unexpected source %+v", source)
+	}
+
+	reader, size, err := yt.Open(server.URL+"/video.mp4", yt.VIDEO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(content) || !bytes.Equal(data, content) {
+		t.Fatalf("expected %d bytes, got size %d and %d bytes read", len(content), size, len(data))
+	}
+}
+
+func TestMediaTypeValues(t *testing.T) {
+
+	// the values are part of the package's API, so constants added later mustn't shift them
+	if yt.UNKNOWN != 3 || yt.VIDEO != 4 || yt.IMAGE != 5 || yt.CAPTION != 6 {
+		t.Fatalf("unexpected media type values %d, %d, %d, %d", yt.UNKNOWN, yt.VIDEO, yt.IMAGE, yt.CAPTION)
+	}
+}
+
+func TestStrictContentType(t *testing.T) {
+
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.mp4")
+	err := os.WriteFile(unknown, make([]byte, 1000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp4 := filepath.Join(dir, "video.mp4")
+	err = os.WriteFile(mp4, append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), make([]byte, 1000)...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// octet-stream is let through, unless the check is strict
+	reader, _, err := yt.Open(unknown, yt.VIDEO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	if _, _, err := yt.Open(unknown, yt.STRICT_VIDEO); err == nil {
+		t.Fatal("expected an error for a file that isn't clearly a video")
+	}
+
+	reader, _, err = yt.Open(mp4, yt.STRICT_VIDEO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+
+	if _, _, err := yt.Open("-", yt.STRICT_VIDEO); err == nil {
+		t.Fatal("expected an error for stdin")
+	}
+}
+
+func TestTitleSuffix(t *testing.T) {
+
+	metaFile := filepath.Join(t.TempDir(), "meta.json")
+	err := os.WriteFile(metaFile, []byte(`{"title": "Long recording"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	suffixConfig := config
+	suffixConfig.MetaJSON = []string{metaFile}
+	suffixConfig.TitleSuffix = " (Part 2/3)"
+	video := &youtube.Video{}
+	_, err = yt.LoadVideoMeta(suffixConfig, video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Snippet.Title != "Long recording (Part 2/3)" {
+		t.Fatalf("unexpected title %q", video.Snippet.Title)
+	}
+
+	// a title that fits on its own is shortened to make room for the suffix, whatever the policy
+	for _, policy := range []string{"error", "truncate"} {
+		suffixConfig.MetaJSON = nil
+		suffixConfig.Title = strings.Repeat("a", 100)
+		suffixConfig.TitleOverflow = policy
+		video = &youtube.Video{}
+		_, err = yt.LoadVideoMeta(suffixConfig, video)
+		if err != nil {
+			t.Fatalf("%s: %s", policy, err)
+		}
+		if want := strings.Repeat("a", 88) + "…" + " (Part 2/3)"; video.Snippet.Title != want {
+			t.Fatalf("%s: expected title %q, got %q", policy, want, video.Snippet.Title)
+		}
+	}
+}
+
+func TestShort(t *testing.T) {
+
+	shortConfig := config
+	shortConfig.Short = true
+
+	tests := []struct {
+		description string
+		want        string
+	}{
+		{"", "#Shorts"},
+		{"My short", "My short\n\n#Shorts"},
+		{"Already tagged #shorts", "Already tagged #shorts"},
+	}
+	for _, test := range tests {
+		shortConfig.Description = test.description
+		video := &youtube.Video{}
+		_, err := yt.LoadVideoMeta(shortConfig, video)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if video.Snippet.Description != test.want {
+			t.Fatalf("expected description %q, got %q", test.want, video.Snippet.Description)
+		}
+	}
+}
+
+func TestRequireDescription(t *testing.T) {
+
+	requireConfig := config
+	requireConfig.RequireDescription = true
+	requireConfig.Short = true
+	requireConfig.AppendSignature = true
+
+	// the #Shorts hashtag and signature don't count as a description
+	requireConfig.Description = ""
+	_, err := yt.LoadVideoMeta(requireConfig, &youtube.Video{})
+	if err == nil {
+		t.Fatal("expected an error for a missing description")
+	}
+
+	requireConfig.Description = "My short"
+	_, err = yt.LoadVideoMeta(requireConfig, &youtube.Video{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadErrors(t *testing.T) {
+
+	defer videoForbiddenReason.Store("")
+
+	kinds := map[string]error{
+		"uploadLimitExceeded":   yt.ErrQuota,
+		"youtubeSignupRequired": yt.ErrAuth,
+	}
+	for reason, kind := range kinds {
+		transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		videoForbiddenReason.Store(reason)
+		err = yt.Run(context.Background(), transport, config, &mockReader{fileSize: 1000})
+		if !errors.Is(err, kind) {
+			t.Fatalf("%s: expected %v, got %v", reason, kind, err)
+		}
+		var uploadErr *yt.UploadError
+		if !errors.As(err, &uploadErr) {
+			t.Fatalf("%s: expected an UploadError, got %T", reason, err)
+		}
+		if uploadErr.StatusCode != http.StatusForbidden || uploadErr.Reason != reason {
+			t.Fatalf("%s: unexpected status %d and reason %q", reason, uploadErr.StatusCode, uploadErr.Reason)
+		}
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("%s: expected the googleapi error to be wrapped", reason)
+		}
+	}
+	videoForbiddenReason.Store("")
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidConfig := config
+	invalidConfig.AutoThumbnail = 5
+	err = yt.Run(context.Background(), transport, invalidConfig, &mockReader{fileSize: 1000})
+	if !errors.Is(err, yt.ErrValidation) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+}
+
+func TestCaptionLanguages(t *testing.T) {
+
+	dir := t.TempDir()
+	captionFile := filepath.Join(dir, "test.srt")
+	err := os.WriteFile(captionFile, []byte("1\n00:00:00,000 --> 00:00:01,000\ntest\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaFile := filepath.Join(dir, "meta.json")
+	meta := fmt.Sprintf(`{"captions": [{"filename": %q, "language": "en", "languages": ["en-GB", "en", "fr"]}]}`, captionFile)
+	err = os.WriteFile(metaFile, []byte(meta), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captionConfig := config
+	captionConfig.PlaylistIDs = nil
+	captionConfig.MetaJSON = []string{metaFile}
+
+	videoMeta, err := yt.LoadVideoMeta(captionConfig, &youtube.Video{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var languages []string
+	for _, caption := range videoMeta.Captions {
+		languages = append(languages, caption.Language)
+	}
+	if !slices.Equal(languages, []string{"en", "en-GB", "fr"}) {
+		t.Fatalf("expected a track per language, got %v", languages)
+	}
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captionRequests.Store(0)
+	err = yt.Run(context.Background(), transport, captionConfig, &mockReader{fileSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := captionRequests.Load(); got != 3 {
+		t.Fatalf("expected 3 caption requests, got %d", got)
+	}
+}
+
+func TestCaptionConcurrency(t *testing.T) {
+
+	dir := t.TempDir()
+	var captions []string
+	var texts []string
+	for i := 1; i <= 4; i++ {
+		text := fmt.Sprintf("caption text %d", i)
+		captionFile := filepath.Join(dir, fmt.Sprintf("test%d.srt", i))
+		err := os.WriteFile(captionFile, []byte("1\n00:00:00,000 --> 00:00:01,000\n"+strings.Repeat(text+"\n", i*100)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		captions = append(captions, fmt.Sprintf(`{"filename": %q, "language": "l%d"}`, captionFile, i))
+		texts = append(texts, text)
+	}
+	metaFile := filepath.Join(dir, "meta.json")
+	err := os.WriteFile(metaFile, []byte(`{"captions": [`+strings.Join(captions, ",")+`]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captionConfig := config
+	captionConfig.PlaylistIDs = nil
+	captionConfig.MetaJSON = []string{metaFile}
+	captionConfig.CaptionConcurrency = 4
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captionBodiesMu.Lock()
+	captionBodies = nil
+	captionBodiesMu.Unlock()
+	err = yt.Run(context.Background(), transport, captionConfig, &mockReader{fileSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each caption is sent whole in its own request, not mixed up with the video or other captions
+	captionBodiesMu.Lock()
+	defer captionBodiesMu.Unlock()
+	if len(captionBodies) != len(texts) {
+		t.Fatalf("expected %d caption requests, got %d", len(texts), len(captionBodies))
+	}
+	for i, text := range texts {
+		found := 0
+		for _, body := range captionBodies {
+			if !strings.Contains(body, text+"\n") {
+				continue
+			}
+			found++
+			if got := strings.Count(body, "caption text"); got != (i+1)*100 {
+				t.Errorf("expected caption %q to be sent whole and alone, got %d lines", text, got)
+			}
+		}
+		if found != 1 {
+			t.Errorf("expected caption %q to be sent once, got %d", text, found)
+		}
+	}
+}
+
+func TestDumpToken(t *testing.T) {
+
+	tokenFile := filepath.Join(t.TempDir(), "request.token")
+	err := os.WriteFile(tokenFile, []byte(`{"access_token": "secret-access", "refresh_token": "secret-refresh", "expiry": "2020-01-01T00:00:00Z"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = yt.DumpToken(&out, tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := out.String()
+	if strings.Contains(dump, "secret") {
+		t.Fatalf("token values were printed:\n%s", dump)
+	}
+	for _, want := range []string{"Refresh token: present", "expired", "will be refreshed"} {
+		if !strings.Contains(dump, want) {
+			t.Fatalf("expected %q in:\n%s", want, dump)
+		}
+	}
+}
+
+func TestWatchDirectory(t *testing.T) {
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.mp4")
+	err := os.WriteFile(existing, make([]byte, 1000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	found := make(chan []string, 10)
+	done := make(chan error)
+	go func() {
+		done <- yt.WatchDirectory(ctx, dir, 0, nil, func(filenames []string) {
+			found <- filenames
+		})
+	}()
+
+	for _, want := range []string{existing, filepath.Join(dir, "new.mp4")} {
+		if want != existing {
+			err := os.WriteFile(want, make([]byte, 1000), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// files that aren't videos are ignored
+			err = os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case filenames := <-found:
+			if !slices.Equal(filenames, []string{want}) {
+				t.Fatalf("expected %q, got %q", want, filenames)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	cancel()
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScopes(t *testing.T) {
+
+	scopes := yt.ParseScopes("youtube.upload, https://www.googleapis.com/auth/youtube.readonly,,youtube.upload")
+	want := []string{"https://www.googleapis.com/auth/youtube.upload", "https://www.googleapis.com/auth/youtube.readonly"}
+	if !slices.Equal(scopes, want) {
+		t.Fatalf("expected %v, got %v", want, scopes)
+	}
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scopeConfig := config
+	scopeConfig.HTTPClient = nil
+	scopeConfig.Scopes = yt.ParseScopes("youtube.readonly")
+	err = yt.Run(context.Background(), transport, scopeConfig, &mockReader{fileSize: 1000})
+	if !errors.Is(err, yt.ErrValidation) {
+		t.Fatalf("expected a validation error without the upload scope, got %v", err)
+	}
+}
+
+func TestTitleFromFilename(t *testing.T) {
+
+	tests := []struct {
+		filename string
+		cleanup  string
+		want     string
+	}{
+		{"/videos/2024-05-01_my_holiday.video.mp4", "", "2024-05-01_my_holiday.video"},
+		{"/videos/2024-05-01_my_holiday.video.mp4", "spaces", "2024-05-01 my holiday video"},
+		{"/videos/2024-05-01_my_holiday.video.mp4", "prefix,spaces", "my holiday video"},
+		{"/videos/2024-05-01_my_holiday.video.mp4", "all", "My Holiday Video"},
+		{"20240501-1830 family visit.mkv", "prefix", "family visit"},
+		{"03 - intro_to_go.mp4", "titlecase,prefix,spaces", "Intro To Go"},
+		{"2024-05-01.mp4", "all", "2024-05-01"},
+		{"GoLang_FAQ.mp4", "spaces,titlecase", "GoLang FAQ"},
+	}
+
+	for _, test := range tests {
+		rules, err := yt.ParseTitleCleanup(test.cleanup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := yt.TitleFromFilename(test.filename, rules)
+		if got != test.want {
+			t.Errorf("%q with %q: expected title %q, got %q", test.filename, test.cleanup, test.want, got)
+		}
+	}
+
+	_, err := yt.ParseTitleCleanup("spaces,lowercase")
+	if err == nil {
+		t.Fatal("expected an error for an unknown rule")
+	}
+}
+
+func TestMetaOutFields(t *testing.T) {
+
+	dir := t.TempDir()
+
+	tests := []struct {
+		fields string
+		indent int
+		want   string
+	}{
+		{"full", 0, `{"id":"test"}`},
+		{"minimal", 0, `{"id":"test"}`},
+		{"minimal", 2, "{\n  \"id\": \"test\"\n}"},
+	}
+
+	for i, test := range tests {
+		transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metaConfig := config
+		metaConfig.MetaJSONOut = filepath.Join(dir, fmt.Sprintf("meta%d.json", i))
+		metaConfig.MetaOutFields = test.fields
+		metaConfig.MetaOutIndent = test.indent
+		err = yt.Run(context.Background(), transport, metaConfig, &mockReader{fileSize: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := os.ReadFile(metaConfig.MetaJSONOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%s with indent %d: expected %q, got %q", test.fields, test.indent, test.want, got)
+		}
+	}
+
+	transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaConfig := config
+	metaConfig.MetaOutFields = "trimmed"
+	err = yt.Run(context.Background(), transport, metaConfig, &mockReader{fileSize: 1000})
+	if !errors.Is(err, yt.ErrValidation) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+}
+
+func TestNotifyAuto(t *testing.T) {
+
+	tomorrow := yt.Date{Time: time.Now().Add(24 * time.Hour)}
+
+	tests := []struct {
+		privacy   string
+		publishAt yt.Date
+		notify    bool
+		want      string
+	}{
+		{"public", yt.Date{}, true, "true"},
+		{"unlisted", yt.Date{}, true, "false"},
+		{"private", yt.Date{}, true, "false"},
+		{"private", tomorrow, true, "true"},
+		{"public", yt.Date{}, false, "false"},
+	}
+
+	for _, test := range tests {
+		transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notifyConfig := config
+		notifyConfig.Privacy = test.privacy
+		notifyConfig.PublishAt = test.publishAt
+		notifyConfig.NotifySubscribers = test.notify
+		notifyConfig.NotifyAuto = true
+		err = yt.Run(context.Background(), transport, notifyConfig, &mockReader{fileSize: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, _ := notifyParam.Load().(string); got != test.want {
+			t.Errorf("%s video, publishAt %v, notify %t: expected notifySubscribers=%s, got %q", test.privacy, !test.publishAt.IsZero(), test.notify, test.want, got)
+		}
+	}
+}
+
+func TestCaptionReplace(t *testing.T) {
+
+	dir := t.TempDir()
+	captionFile := filepath.Join(dir, "test.srt")
+	err := os.WriteFile(captionFile, []byte("1\n00:00:00,000 --> 00:00:01,000\ntest\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaFile := filepath.Join(dir, "meta.json")
+	err = os.WriteFile(metaFile, []byte(`{"captions": [{"filename": "`+filepath.ToSlash(captionFile)+`", "languages": ["en", "fr"]}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, replace := range []bool{false, true} {
+		transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		captionConfig := config
+		captionConfig.PlaylistIDs = nil
+		captionConfig.MetaJSON = []string{metaFile}
+		captionConfig.CaptionReplace = replace
+
+		captionRequests.Store(0)
+		captionUpdates.Store(0)
+		err = yt.Run(context.Background(), transport, captionConfig, &mockReader{fileSize: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// only the English track is updated, as the French one was generated by YouTube
+		wantUpdates := int32(0)
+		if replace {
+			wantUpdates = 1
+		}
+		if got := captionRequests.Load(); got != 2 {
+			t.Errorf("replace %t: expected 2 caption requests, got %d", replace, got)
+		}
+		if got := captionUpdates.Load(); got != wantUpdates {
+			t.Errorf("replace %t: expected %d caption updates, got %d", replace, wantUpdates, got)
+		}
+	}
+}
+
+func TestLocalizations(t *testing.T) {
+
+	tests := []struct {
+		meta    string
+		want    []string
+		wantErr bool
+	}{
+		{`{"language": "en", "localizations": {"fr": {"title": "Bonjour", "description": "Une vidéo"}}}`, []string{"fr"}, false},
+		// the video's own title and description are used for its language
+		{`{"language": "en", "localizations": {"en": {"title": "Hello", "description": "A video"}, "de": {"title": "Hallo", "description": "Ein Video"}}}`, []string{"de"}, false},
+		{`{"localizations": {"fr": {"title": "Bonjour", "description": "Une vidéo"}}}`, nil, true},
+		{`{"language": "en", "localizations": {"fr": {"title": "Bonjour"}}}`, nil, true},
+		{`{"language": "en", "localizations": {"fr": {"description": "Une vidéo"}}}`, nil, true},
+	}
+
+	for _, test := range tests {
+		localizationConfig := config
+		localizationConfig.PlaylistIDs = nil
+		localizationConfig.Meta = json.RawMessage(test.meta)
+
+		video := &youtube.Video{}
+		_, err := yt.LoadVideoMeta(localizationConfig, video)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.meta)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.meta, err)
+		}
+		var languages []string
+		for lang := range video.Localizations {
+			languages = append(languages, lang)
+		}
+		if !slices.Equal(languages, test.want) {
+			t.Errorf("%s: expected localizations %v, got %v", test.meta, test.want, languages)
+		}
+	}
+}
+
+func TestProgressFileRotation(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "progress.log")
+	line := []byte(strings.Repeat("x", 99) + "\n")
+
+	w := progress.NewRotatingWriter(filename, 250)
+	for i := 0; i < 5; i++ {
+		_, err := w.Write(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lines 1 and 2 were rotated away by line 5, and lines aren't split across files
+	for name, want := range map[string]int{filename: 100, filename + ".1": 200} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(want) {
+			t.Errorf("expected %q to be %d bytes, got %d", name, want, info.Size())
+		}
+	}
+
+	// a new writer appends to the existing file
+	w = progress.NewRotatingWriter(filename, 250)
+	_, err = w.Write(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 200 {
+		t.Errorf("expected %q to be appended to, got %d bytes", filename, info.Size())
+	}
+}
+
+func TestPlaylistThumbnail(t *testing.T) {
+
+	thumbnail := filepath.Join(t.TempDir(), "playlist.png")
+	err := os.WriteFile(thumbnail, []byte("\x89PNG\r\n\x1a\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only playlists created for the video get the thumbnail, not existing ones
+	tests := []struct {
+		playlists string
+		want      int32
+	}{
+		{`{"playlistTitles": ["Test Playlist 1"]}`, 0},
+		{`{"playlistTitles": ["New Playlist"]}`, 1},
+	}
+
+	for _, test := range tests {
+		transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		playlistConfig := config
+		playlistConfig.PlaylistIDs = nil
+		playlistConfig.Meta = json.RawMessage(test.playlists)
+		playlistConfig.PlaylistThumbnail = thumbnail
+
+		playlistImageRequests.Store(0)
+		err = yt.Run(context.Background(), transport, playlistConfig, &mockReader{fileSize: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := playlistImageRequests.Load(); got != test.want {
+			t.Errorf("%s: expected %d playlist thumbnail uploads, got %d", test.playlists, test.want, got)
+		}
+	}
+}
+
+// failingTransport fails every request after delay, counting them
+type failingTransport struct {
+	delay    time.Duration
+	requests int
+}
+
+func (f *failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.requests++
+	_, _ = io.Copy(io.Discard, r.Body)
+	r.Body.Close()
+	time.Sleep(f.delay)
+	return nil, io.ErrUnexpectedEOF
+}
+
+func TestMaxRetryDuration(t *testing.T) {
+
+	base := &failingTransport{delay: 60 * time.Millisecond}
+	transport, err := limiter.NewLimitTransport(config.Logger, base, limiter.LimitRange{}, 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transport.SetMaxRetryDuration(100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same chunk is sent until the time spent retrying it is used up
+	for attempt := 1; attempt <= 3; attempt++ {
+		req, err := http.NewRequestWithContext(limiter.WithUpload(context.Background()), http.MethodPut, "https://example.com/upload", bytes.NewReader(make([]byte, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", "bytes 0-9/20")
+		_, err = transport.RoundTrip(req)
+		if attempt < 3 && errors.Is(err, limiter.ErrRetryDuration) {
+			t.Fatalf("attempt %d: retry duration reached too soon", attempt)
+		}
+		if attempt == 3 && !errors.Is(err, limiter.ErrRetryDuration) {
+			t.Fatalf("attempt %d: expected the retry duration to be reached, got %v", attempt, err)
+		}
+	}
+	if base.requests != 2 {
+		t.Fatalf("expected 2 requests to be sent, got %d", base.requests)
+	}
+}
+
+func TestStdinFormat(t *testing.T) {
+
+	tests := []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{"mp4", "video/mp4", false},
+		{".MKV", "video/x-matroska", false},
+		{"video/webm", "video/webm", false},
+		{"mp3", "", true},
+		{"audio/mpeg", "", true},
+	}
+
+	for _, test := range tests {
+		transport, err := limiter.NewLimitTransport(config.Logger, transport, limiter.LimitRange{}, 1000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdinConfig := config
+		stdinConfig.Filename = "-"
+		stdinConfig.StdinFormat = test.format
+
+		mediaContentType.Store("")
+		err = yt.Run(context.Background(), transport, stdinConfig, &mockReader{fileSize: 1000})
+		if test.wantErr {
+			if !errors.Is(err, yt.ErrValidation) {
+				t.Errorf("%q: expected a validation error, got %v", test.format, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := mediaContentType.Load().(string); got != test.want {
+			t.Errorf("%q: expected content type %q, got %q", test.format, test.want, got)
+		}
+	}
+}
+
+func TestValidTokenInvalidGrant(t *testing.T) {
+
+	var revoked atomic.Bool
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if revoked.Load() {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, `{"error": "invalid_grant"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"access_token": "refreshed", "token_type": "Bearer", "expires_in": 3600}`)
+	}))
+	defer tokenServer.Close()
+
+	oauthConfig := &oauth2.Config{
+		ClientID: "test",
+		Endpoint: oauth2.Endpoint{TokenURL: tokenServer.URL, AuthStyle: oauth2.AuthStyleInParams},
+	}
+	cacheFile := yt.CacheFile(filepath.Join(t.TempDir(), "request.token"))
+	expired := &oauth2.Token{AccessToken: "expired", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+
+	err := cacheFile.PutToken(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := cacheFile.ValidToken(context.Background(), oauthConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "refreshed" {
+		t.Fatalf("expected the token to be refreshed, got access token %q", token.AccessToken)
+	}
+
+	// a revoked token is kept as a backup, so that a new one is requested
+	revoked.Store(true)
+	_, err = cacheFile.ValidToken(context.Background(), oauthConfig)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := os.Stat(string(cacheFile)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected %q to have been moved", cacheFile)
+	}
+	backup, err := yt.CacheFile(string(cacheFile) + ".bak").Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.RefreshToken != "refresh" {
+		t.Fatalf("expected the backup to hold the revoked token, got %+v", backup)
+	}
+}
+
+func TestDirectoryVideoExtensions(t *testing.T) {
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"a.mp4":     make([]byte, 1000),
+		"b.MKV":     make([]byte, 1000),
+		"c.mov":     make([]byte, 1000),
+		"d.txt":     make([]byte, 1000),
+		"notes.mp4": []byte("not a video"),
+		"empty.mp4": nil,
+	}
+	for name, data := range files {
+		err := os.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		extensions []string
+		want       []string
+	}{
+		{nil, []string{"a.mp4", "b.MKV", "c.mov"}},
+		{[]string{".mp4", ".mkv"}, []string{"a.mp4", "b.MKV"}},
+		{[]string{".txt"}, []string{"d.txt"}},
+	}
+
+	for _, test := range tests {
+		filenames, err := yt.DirectoryVideos(dir, 0, test.extensions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, filename := range filenames {
+			got = append(got, filepath.Base(filename))
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("extensions %v: expected %v, got %v", test.extensions, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package youtubeuploader
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/porjo/youtubeuploader/internal/limiter"
+	"github.com/porjo/youtubeuploader/internal/utils"
+)
+
+// LimitTransport tracks the progress of an upload and applies the rate limit. It's an alias,
+// so that programs outside this module can create one with NewLimitTransport
+type LimitTransport = limiter.LimitTransport
+
+// NewLimitTransport returns a LimitTransport wrapping rt, for use with Upload. filesize is
+// the size of the video in bytes, zero if unknown. rateLimit is in Kbps, zero for no limit
+func NewLimitTransport(rt http.RoundTripper, filesize, rateLimit int, debug bool) (*LimitTransport, error) {
+	return limiter.NewLimitTransport(utils.NewLogger(debug), rt, limiter.LimitRange{}, filesize, rateLimit)
+}
+
+// TransportOptions configures the transport returned by NewTransport
+type TransportOptions struct {
+	// MinTLS is the minimum TLS version, "1.2" or "1.3". Empty keeps the Go default
+	MinTLS string
+	// DisableHTTP2 forces HTTP/1.1, for networks or proxies that handle HTTP/2 badly
+	DisableHTTP2 bool
+	// BindAddr is the local IP address connections are made from. Interface is the name of
+	// the network interface to use instead, whose first address is used. At most one can be set
+	BindAddr  string
+	Interface string
+}
+
+// NewTransport returns a copy of http.DefaultTransport configured by opts
+func NewTransport(opts TransportOptions) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	switch opts.MinTLS {
+	case "":
+	case "1.2":
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	case "1.3":
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS13}
+	default:
+		return nil, fmt.Errorf("unsupported minimum TLS version %q, must be 1.2 or 1.3", opts.MinTLS)
+	}
+
+	if opts.DisableHTTP2 {
+		// a non-nil, empty map stops HTTP/2 being negotiated
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	localAddr, err := localAddress(opts.BindAddr, opts.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if localAddr != nil {
+		// the same timeouts as http.DefaultTransport
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			LocalAddr: localAddr,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+
+	return transport, nil
+}
+
+// localAddress returns the local address to dial from, given either an IP address or an
+// interface name. It returns nil if neither is set
+func localAddress(bindAddr, iface string) (*net.TCPAddr, error) {
+	switch {
+	case bindAddr != "" && iface != "":
+		return nil, errors.New("a bind address and an interface can't both be set")
+
+	case bindAddr != "":
+		ip := net.ParseIP(bindAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address %q", bindAddr)
+		}
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return &net.TCPAddr{IP: ip}, nil
+			}
+		}
+		return nil, fmt.Errorf("bind address %s isn't assigned to any network interface", bindAddr)
+
+	case iface != "":
+		netIface, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, fmt.Errorf("network interface %q: %w", iface, err)
+		}
+		addrs, err := netIface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("network interface %q: %w", iface, err)
+		}
+		// prefer IPv4, as it's more likely to be routable
+		var found net.IP
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ipNet.IP.To4() != nil {
+				return &net.TCPAddr{IP: ipNet.IP}, nil
+			}
+			if found == nil {
+				found = ipNet.IP
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("network interface %q has no usable address", iface)
+		}
+		return &net.TCPAddr{IP: found}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,95 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package youtubeuploader
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettle is how long a watched directory must be quiet before it's scanned for new videos
+const watchSettle = 2 * time.Second
+
+// WatchDirectory calls handle with the videos in dir, then with each new video that appears in it, until
+// ctx is cancelled. Videos are found as by DirectoryVideos, and those modified more recently than minAge
+// are held back until they're old enough.
+// Each video is passed to handle only once, unless it's removed and a video with the same name appears
+func WatchDirectory(ctx context.Context, dir string, minAge time.Duration, extensions []string, handle func(filenames []string)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating directory watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	err = watcher.Add(dir)
+	if err != nil {
+		return fmt.Errorf("error watching directory %q: %w", dir, err)
+	}
+
+	seen := make(map[string]bool)
+	scan := func() error {
+		filenames, err := DirectoryVideos(dir, minAge, extensions)
+		if err != nil {
+			return err
+		}
+		var added []string
+		for _, filename := range filenames {
+			if !seen[filename] {
+				seen[filename] = true
+				added = append(added, filename)
+			}
+		}
+		if len(added) > 0 {
+			handle(added)
+		}
+		return nil
+	}
+
+	err = scan()
+	if err != nil {
+		return err
+	}
+
+	// a video is usually written in many chunks, so the directory is scanned once the events stop
+	// and the video is older than minAge. The first timer picks up videos too new for the scan above
+	timer := time.NewTimer(minAge + watchSettle)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				delete(seen, event.Name)
+			}
+			timer.Reset(minAge + watchSettle)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Printf("WARNING: error watching directory %q: %s\n", dir, err)
+		case <-timer.C:
+			err = scan()
+			if err != nil {
+				fmt.Printf("WARNING: %s\n", err)
+			}
+		}
+	}
+}